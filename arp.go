@@ -0,0 +1,460 @@
+package microps
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+// ARPメッセージ（Ethernet / IP）のサイズ
+const ARPEtherSize = 28
+
+// ハードウェアアドレス種別
+const ARPHrdEther uint16 = 0x0001
+
+// プロトコルアドレス種別（EtherType と同じ値を使う）
+const ARPProIP uint16 = 0x0800
+
+// ARPオペレーション種別
+type ARPOp uint16
+
+const (
+	ARPOpRequest ARPOp = 1
+	ARPOpReply   ARPOp = 2
+)
+
+func (op ARPOp) String() string {
+	switch op {
+	case ARPOpRequest:
+		return "Request"
+	case ARPOpReply:
+		return "Reply"
+	default:
+		return "Unknown"
+	}
+}
+
+const ARPCacheSize = 32
+const ARPCacheTimeout = 30 * time.Second
+
+const ARPTimerInterval = 1 * time.Second
+
+// ARPキャッシュの状態
+type ARPCacheState uint8
+
+const (
+	ARPCacheStateFree ARPCacheState = iota
+	ARPCacheStateIncomplete
+	ARPCacheStateResolved
+	ARPCacheStateStatic
+)
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// ARPヘッダ
+type ARPHdr struct {
+	Hrd uint16 // Hardware Type
+	Pro uint16 // Protocol Type
+	Hln uint8  // Hardware Address Length
+	Pln uint8  // Protocol Address Length
+	Op  uint16 // Operation
+}
+
+// ARPメッセージ（Ethernet / IP）
+type ARPEther struct {
+	ARPHdr
+	Sha EtherAddr // Sender Hardware Address
+	Spa IPAddr    // Sender Protocol Address
+	Tha EtherAddr // Target Hardware Address
+	Tpa IPAddr    // Target Protocol Address
+}
+
+func (msg *ARPEther) Marshal(b []uint8) {
+	binary.NativeEndian.PutUint16(b[0:], msg.Hrd)
+	binary.NativeEndian.PutUint16(b[2:], msg.Pro)
+	b[4] = msg.Hln
+	b[5] = msg.Pln
+	binary.NativeEndian.PutUint16(b[6:], msg.Op)
+	copy(b[8:14], msg.Sha[:])
+	binary.NativeEndian.PutUint32(b[14:], uint32(msg.Spa))
+	copy(b[18:24], msg.Tha[:])
+	binary.NativeEndian.PutUint32(b[24:], uint32(msg.Tpa))
+}
+
+func (msg *ARPEther) Unmarshal(b []uint8) bool {
+	if len(b) < ARPEtherSize {
+		return false
+	}
+	msg.Hrd = binary.NativeEndian.Uint16(b[0:])
+	msg.Pro = binary.NativeEndian.Uint16(b[2:])
+	msg.Hln = b[4]
+	msg.Pln = b[5]
+	msg.Op = binary.NativeEndian.Uint16(b[6:])
+	copy(msg.Sha[:], b[8:14])
+	msg.Spa = IPAddr(binary.NativeEndian.Uint32(b[14:]))
+	copy(msg.Tha[:], b[18:24])
+	msg.Tpa = IPAddr(binary.NativeEndian.Uint32(b[24:]))
+	return true
+}
+
+// ARPキャッシュ
+type arpCache struct {
+	state     ARPCacheState
+	pa        IPAddr
+	ha        EtherAddr
+	timestamp time.Time
+}
+
+// ARPプロトコル
+type ARPProtocol struct {
+	NetProtocolInfo
+}
+
+func (proto *ARPProtocol) Info() *NetProtocolInfo {
+	return &proto.NetProtocolInfo
+}
+
+// 書籍では arp_input()
+func (proto *ARPProtocol) InputHandler(data []uint8, dev NetDevice) {
+	if len(data) < ARPEtherSize {
+		logARP.Errorf("too short")
+		return
+	}
+
+	var msg ARPEther
+	if !msg.Unmarshal(data) {
+		logARP.Errorf("Unmarshal() failure")
+		return
+	}
+
+	if util.Ntoh16(msg.Hrd) != ARPHrdEther || msg.Hln != EtherAddrLen {
+		logARP.Errorf("unsupported hardware address")
+		return
+	}
+	if util.Ntoh16(msg.Pro) != ARPProIP || msg.Pln != IPAddrLen {
+		logARP.Errorf("unsupported protocol address")
+		return
+	}
+
+	logARP.Debugf("dev=%s, len=%d", dev.Info().Name, len(data))
+	arpPrint(data, proto.stack.dumpProtocol(NetProtocolTypeARP))
+
+	stack := proto.stack
+
+	// 送信元のエントリが存在すれば更新する
+	stack.arp.mutex.Lock()
+	merge := stack.arpCacheUpdate(msg.Spa, msg.Sha)
+	stack.arp.mutex.Unlock()
+
+	i := stack.NetDeviceGetIface(dev, NetIfaceFamilyIP)
+	iface, ok := i.(*IPIface)
+	if !ok || iface.unicast != msg.Tpa {
+		// 自分宛てではないため無視
+		return
+	}
+
+	if !merge {
+		// 自分宛ての場合は送信元のエントリを新規に登録する
+		stack.arp.mutex.Lock()
+		stack.arpCacheInsert(msg.Spa, msg.Sha)
+		stack.arp.mutex.Unlock()
+	}
+
+	if ARPOp(util.Ntoh16(msg.Op)) == ARPOpRequest {
+		stack.arpReply(iface, msg.Sha, msg.Spa, msg.Sha)
+	}
+}
+
+// ARPの状態
+type arpState struct {
+	caches [ARPCacheSize]arpCache // ARPキャッシュテーブル
+	mutex  sync.Mutex
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// NOTE: 16進ダンプは全体のダンプ出力が有効な場合のみ出力する
+func ARPPrint(data []uint8) {
+	arpPrint(data, util.DumpEnabled())
+}
+
+func arpPrint(data []uint8, hex bool) {
+	if !logARP.Enabled(slog.LevelDebug) && !hex {
+		return
+	}
+
+	var msg ARPEther
+	if !msg.Unmarshal(data) {
+		logARP.Errorf("Unmarshal() failure")
+		return
+	}
+
+	op := ARPOp(util.Ntoh16(msg.Op))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "        hrd: 0x%04x\n", util.Ntoh16(msg.Hrd))
+	fmt.Fprintf(&sb, "        pro: 0x%04x\n", util.Ntoh16(msg.Pro))
+	fmt.Fprintf(&sb, "        hln: %d\n", msg.Hln)
+	fmt.Fprintf(&sb, "        pln: %d\n", msg.Pln)
+	fmt.Fprintf(&sb, "         op: %d (%s)\n", op, op.String())
+	fmt.Fprintf(&sb, "        sha: %s\n", msg.Sha.String())
+	fmt.Fprintf(&sb, "        spa: %s\n", msg.Spa.String())
+	fmt.Fprintf(&sb, "        tha: %s\n", msg.Tha.String())
+	fmt.Fprintf(&sb, "        tpa: %s\n", msg.Tpa.String())
+
+	logARP.Dump(sb.String(), data, hex)
+}
+
+// NOTE: 以降の arpCacheXxx() は arp.mutex をロックした状態で呼び出すこと
+
+func (stack *Stack) arpCacheDelete(cache *arpCache) {
+	logARP.Debugf("DELETE: pa=%s, ha=%s", cache.pa.String(), cache.ha.String())
+
+	cache.state = ARPCacheStateFree
+	cache.pa = 0
+	cache.ha = EtherAddrEmpty
+	cache.timestamp = time.Time{}
+}
+
+func (stack *Stack) arpCacheAlloc() *arpCache {
+	var oldest *arpCache
+	for i := range stack.arp.caches {
+		cache := &stack.arp.caches[i]
+		if cache.state == ARPCacheStateFree {
+			return cache
+		}
+		if cache.state == ARPCacheStateStatic {
+			// 静的エントリは追い出さない
+			continue
+		}
+		if oldest == nil || oldest.timestamp.After(cache.timestamp) {
+			oldest = cache
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+
+	// 空きが無い場合は最も古いエントリを再利用する
+	stack.arpCacheDelete(oldest)
+	return oldest
+}
+
+func (stack *Stack) arpCacheSelect(pa IPAddr) *arpCache {
+	for i := range stack.arp.caches {
+		cache := &stack.arp.caches[i]
+		if cache.state != ARPCacheStateFree && cache.pa == pa {
+			return cache
+		}
+	}
+	return nil
+}
+
+func (stack *Stack) arpCacheUpdate(pa IPAddr, ha EtherAddr) bool {
+	cache := stack.arpCacheSelect(pa)
+	if cache == nil {
+		return false
+	}
+	if cache.state == ARPCacheStateStatic {
+		// 静的エントリは更新しない
+		return true
+	}
+
+	cache.state = ARPCacheStateResolved
+	cache.ha = ha
+	cache.timestamp = time.Now()
+
+	logARP.Debugf("UPDATE: pa=%s, ha=%s", pa.String(), ha.String())
+	return true
+}
+
+func (stack *Stack) arpCacheInsert(pa IPAddr, ha EtherAddr) bool {
+	cache := stack.arpCacheAlloc()
+	if cache == nil {
+		logARP.Errorf("arpCacheAlloc() failure")
+		return false
+	}
+
+	cache.state = ARPCacheStateResolved
+	cache.pa = pa
+	cache.ha = ha
+	cache.timestamp = time.Now()
+
+	logARP.Debugf("INSERT: pa=%s, ha=%s", pa.String(), ha.String())
+	return true
+}
+
+// 書籍では arp_timer_handler()
+func (stack *Stack) arpTimerHandler() {
+	stack.arp.mutex.Lock()
+	defer stack.arp.mutex.Unlock()
+
+	now := time.Now()
+	for i := range stack.arp.caches {
+		cache := &stack.arp.caches[i]
+		if cache.state == ARPCacheStateFree || cache.state == ARPCacheStateStatic {
+			continue
+		}
+		if now.Sub(cache.timestamp) > ARPCacheTimeout {
+			stack.arpCacheDelete(cache)
+		}
+	}
+}
+
+func (stack *Stack) arpRequest(iface *IPIface, tpa IPAddr) error {
+	dev := iface.Info().Dev
+
+	msg := ARPEther{
+		ARPHdr: ARPHdr{
+			Hrd: util.Hton16(ARPHrdEther),
+			Pro: util.Hton16(ARPProIP),
+			Hln: EtherAddrLen,
+			Pln: IPAddrLen,
+			Op:  util.Hton16(uint16(ARPOpRequest)),
+		},
+		Sha: EtherAddr(dev.Info().Addr[:EtherAddrLen]),
+		Spa: iface.unicast,
+		Tha: EtherAddrEmpty,
+		Tpa: tpa,
+	}
+
+	buf := make([]uint8, ARPEtherSize)
+	msg.Marshal(buf)
+
+	logARP.Debugf("dev=%s, len=%d", dev.Info().Name, len(buf))
+	arpPrint(buf, stack.dumpProtocol(NetProtocolTypeARP))
+
+	return stack.NetDeviceOutput(dev, NetProtocolTypeARP, buf, dev.Info().Broadcast)
+}
+
+func (stack *Stack) arpReply(iface *IPIface, tha EtherAddr, tpa IPAddr, dst EtherAddr) error {
+	dev := iface.Info().Dev
+
+	msg := ARPEther{
+		ARPHdr: ARPHdr{
+			Hrd: util.Hton16(ARPHrdEther),
+			Pro: util.Hton16(ARPProIP),
+			Hln: EtherAddrLen,
+			Pln: IPAddrLen,
+			Op:  util.Hton16(uint16(ARPOpReply)),
+		},
+		Sha: EtherAddr(dev.Info().Addr[:EtherAddrLen]),
+		Spa: iface.unicast,
+		Tha: tha,
+		Tpa: tpa,
+	}
+
+	buf := make([]uint8, ARPEtherSize)
+	msg.Marshal(buf)
+
+	logARP.Debugf("dev=%s, len=%d", dev.Info().Name, len(buf))
+	arpPrint(buf, stack.dumpProtocol(NetProtocolTypeARP))
+
+	var hwaddr [netDeviceAddrLen]uint8
+	copy(hwaddr[:], dst[:])
+	return stack.NetDeviceOutput(dev, NetProtocolTypeARP, buf, hwaddr)
+}
+
+// NOTE: アドレス解決中の場合は ErrARPIncomplete を返す
+// 書籍では arp_resolve()
+func (stack *Stack) ARPResolve(iface *IPIface, pa IPAddr) (EtherAddr, error) {
+	dev := iface.Info().Dev
+	if dev.Info().Typ != NetDeviceTypeEthernet {
+		logARP.Errorf("unsupported hardware address type")
+		return EtherAddrEmpty, fmt.Errorf("%w: hardware address type, dev=%s", ErrUnsupported, dev.Info().Name)
+	}
+	if iface.Info().Family != NetIfaceFamilyIP {
+		logARP.Errorf("unsupported protocol address type")
+		return EtherAddrEmpty, fmt.Errorf("%w: protocol address type, dev=%s", ErrUnsupported, dev.Info().Name)
+	}
+
+	stack.arp.mutex.Lock()
+
+	cache := stack.arpCacheSelect(pa)
+	if cache == nil {
+		cache = stack.arpCacheAlloc()
+		if cache == nil {
+			stack.arp.mutex.Unlock()
+			logARP.Errorf("arpCacheAlloc() failure")
+			return EtherAddrEmpty, fmt.Errorf("%w: arp cache", ErrNoResource)
+		}
+		cache.state = ARPCacheStateIncomplete
+		cache.pa = pa
+		cache.timestamp = time.Now()
+		stack.arp.mutex.Unlock()
+
+		stack.arpRequest(iface, pa)
+		logARP.Debugf("cache not found, pa=%s", pa.String())
+		return EtherAddrEmpty, fmt.Errorf("%w, pa=%s", ErrARPIncomplete, pa.String())
+	}
+
+	if cache.state == ARPCacheStateIncomplete {
+		stack.arp.mutex.Unlock()
+
+		// パケットロストに備えて再送する
+		stack.arpRequest(iface, pa)
+		return EtherAddrEmpty, fmt.Errorf("%w, pa=%s", ErrARPIncomplete, pa.String())
+	}
+
+	ha := cache.ha
+	stack.arp.mutex.Unlock()
+
+	logARP.Debugf("resolved, pa=%s, ha=%s", pa.String(), ha.String())
+	return ha, nil
+}
+
+// 静的エントリを登録する（書籍には無い機能）
+func (stack *Stack) ARPCacheAddStatic(pa IPAddr, ha EtherAddr) error {
+	stack.arp.mutex.Lock()
+	defer stack.arp.mutex.Unlock()
+
+	cache := stack.arpCacheSelect(pa)
+	if cache == nil {
+		cache = stack.arpCacheAlloc()
+		if cache == nil {
+			logARP.Errorf("arpCacheAlloc() failure")
+			return fmt.Errorf("%w: arp cache", ErrNoResource)
+		}
+	}
+
+	cache.state = ARPCacheStateStatic
+	cache.pa = pa
+	cache.ha = ha
+	cache.timestamp = time.Now()
+
+	logARP.Infof("success, pa=%s, ha=%s", pa.String(), ha.String())
+	return nil
+}
+
+func (stack *Stack) ARPInit() error {
+	proto := ARPProtocol{
+		NetProtocolInfo{
+			Typ: NetProtocolTypeARP,
+		},
+	}
+
+	if err := stack.NetProtocolRegister(&proto); err != nil {
+		logARP.Errorf("NetProtocolRegister() failure")
+		return err
+	}
+
+	if err := stack.NetTimerRegister("ARP Timer", ARPTimerInterval, stack.arpTimerHandler); err != nil {
+		logARP.Errorf("NetTimerRegister() failure")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package microps
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bugph0bia/go-microps/internal/pcap"
+)
+
+// ----------------------------------------------------------------------------
+// パケットキャプチャ（書籍には無い機能）
+//
+// NOTE:
+//   デバイスごとに送受信したデータを pcap/pcapng 形式で書き出し、Wireshark などで確認できるようにする
+//   リンク種別はデバイスの種別に合わせる
+//     Ethernet  : DLT_EN10MB（EtherOutputHelper() と EtherInputHelper() でフレーム全体を書き出す）
+//     ループバック: DLT_NULL（NetDeviceOutput() と NetInput() でアドレスファミリを付加して書き出す）
+//     その他    : DLT_RAW（NetDeviceOutput() と NetInput() で IP データグラムをそのまま書き出す）
+// ----------------------------------------------------------------------------
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+// キャプチャファイルの形式
+type CaptureFormat int
+
+const (
+	CaptureFormatPcap CaptureFormat = iota
+	CaptureFormatPcapng
+)
+
+// データの向き
+const (
+	captureInbound  = pcap.DirectionInbound
+	captureOutbound = pcap.DirectionOutbound
+)
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// デバイスのキャプチャの状態
+type netCapture struct {
+	mutex    sync.Mutex
+	linkType pcap.LinkType
+	pcap     *pcap.Writer
+	pcapng   *pcap.NgWriter
+	closer   io.Closer // キャプチャを終了したときに閉じるファイル
+	closed   bool
+}
+
+func (c *netCapture) write(dev NetDevice, data []uint8, dir pcap.Direction) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		// 書き出す直前にキャプチャが終了された
+		return
+	}
+
+	var err error
+	if c.pcapng != nil {
+		err = c.pcapng.Write(time.Now(), data, dir)
+	} else {
+		err = c.pcap.Write(time.Now(), data)
+	}
+	if err != nil {
+		logNet.Errorf("write failure, dev=%s, err=%v", dev.Info().Name, err)
+	}
+}
+
+func (c *netCapture) close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// デバイスのキャプチャを開始して w に書き出す
+// NOTE: w はキャプチャを終了した後に呼び出し元で閉じること
+func (stack *Stack) CaptureStart(dev NetDevice, w io.Writer, format CaptureFormat) error {
+	return stack.captureStart(dev, w, format, nil)
+}
+
+// デバイスのキャプチャを開始してファイルに書き出す
+// NOTE: ファイルはキャプチャを終了したとき（デバイスを削除したときを含む）に閉じる
+func (stack *Stack) CaptureStartFile(dev NetDevice, name string, format CaptureFormat) error {
+	file, err := os.Create(name)
+	if err != nil {
+		logNet.Errorf("os.Create() failure, name=%s, err=%v", name, err)
+		return fmt.Errorf("%w: %w", ErrDeviceIO, err)
+	}
+	if err := stack.captureStart(dev, file, format, file); err != nil {
+		file.Close()
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+func (stack *Stack) captureStart(dev NetDevice, w io.Writer, format CaptureFormat, closer io.Closer) error {
+	if dev.Info().capture.Load() != nil {
+		logNet.Errorf("already capturing, dev=%s", dev.Info().Name)
+		return fmt.Errorf("%w: already capturing, dev=%s", ErrAlreadyExists, dev.Info().Name)
+	}
+
+	c := &netCapture{
+		linkType: captureLinkType(dev),
+		closer:   closer,
+	}
+	var err error
+	switch format {
+	case CaptureFormatPcap:
+		c.pcap, err = pcap.NewWriter(w, c.linkType, pcap.SnapLenDefault)
+	case CaptureFormatPcapng:
+		c.pcapng, err = pcap.NewNgWriter(w, c.linkType, pcap.SnapLenDefault, dev.Info().Name)
+	default:
+		logNet.Errorf("unsupported format, format=%d", format)
+		return fmt.Errorf("%w: unsupported format, format=%d", ErrInvalidArgument, format)
+	}
+	if err != nil {
+		logNet.Errorf("write failure, dev=%s, err=%v", dev.Info().Name, err)
+		return fmt.Errorf("%w: %w", ErrDeviceIO, err)
+	}
+
+	if !dev.Info().capture.CompareAndSwap(nil, c) {
+		logNet.Errorf("already capturing, dev=%s", dev.Info().Name)
+		return fmt.Errorf("%w: already capturing, dev=%s", ErrAlreadyExists, dev.Info().Name)
+	}
+
+	logNet.Infof("capture started, dev=%s, linktype=%d", dev.Info().Name, c.linkType)
+	return nil
+}
+
+// デバイスのキャプチャを終了する
+func (stack *Stack) CaptureStop(dev NetDevice) error {
+	c := dev.Info().capture.Swap(nil)
+	if c == nil {
+		logNet.Errorf("not capturing, dev=%s", dev.Info().Name)
+		return fmt.Errorf("%w: not capturing, dev=%s", ErrNotFound, dev.Info().Name)
+	}
+	if err := c.close(); err != nil {
+		logNet.Errorf("close failure, dev=%s, err=%v", dev.Info().Name, err)
+		return fmt.Errorf("%w: %w", ErrDeviceIO, err)
+	}
+
+	logNet.Infof("capture stopped, dev=%s", dev.Info().Name)
+	return nil
+}
+
+func captureLinkType(dev NetDevice) pcap.LinkType {
+	switch dev.Info().Typ {
+	case NetDeviceTypeEthernet:
+		return pcap.LinkTypeEthernet
+	case NetDeviceTypeLoopback:
+		return pcap.LinkTypeNull
+	default:
+		return pcap.LinkTypeRaw
+	}
+}
+
+// Ethernet デバイスが送受信したフレームを書き出す
+func captureFrame(dev NetDevice, frame []uint8, dir pcap.Direction) {
+	if c := dev.Info().capture.Load(); c != nil {
+		c.write(dev, frame, dir)
+	}
+}
+
+// Ethernet 以外のデバイスが送受信したデータを書き出す
+// NOTE: Ethernet デバイスの場合は captureFrame() で書き出すため何もしない
+func captureNet(dev NetDevice, typ NetProtocolType, data []uint8, dir pcap.Direction) {
+	c := dev.Info().capture.Load()
+	if c == nil || c.linkType == pcap.LinkTypeEthernet {
+		return
+	}
+	if typ != NetProtocolTypeIP {
+		// リンク種別で表現できないため書き出さない
+		return
+	}
+
+	if c.linkType == pcap.LinkTypeNull {
+		// NOTE: DLT_NULL のアドレスファミリはキャプチャしたホストのバイトオーダーで格納する
+		hdr := binary.NativeEndian.AppendUint32(make([]uint8, 0, pcapLoopbackHdrSize+len(data)), pcapAddrFamilyInet)
+		data = append(hdr, data...)
+	}
+	c.write(dev, data, dir)
+}
+
+// デバイスを削除したときにキャプチャを終了する
+func captureClose(dev NetDevice) {
+	if c := dev.Info().capture.Swap(nil); c != nil {
+		c.close()
+	}
+}
@@ -0,0 +1,82 @@
+package microps
+
+import (
+	"io"
+	"sync"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+// ----------------------------------------------------------------------------
+// ダンプ出力の制御（書籍には無い機能）
+//
+// NOTE:
+//   全体のフラグが有効な場合はすべてのデータを16進ダンプする
+//   無効な場合はデバイス・プロトコルごとのフラグが有効なものだけを16進ダンプする
+//     デバイス      : デバイスの入出力とEthernetフレーム
+//     プロトコル    : ARP、IP のパケット（受信キューへの出し入れを含む）
+//     上位プロトコル: ICMP、UDP、TCP のメッセージ・セグメント
+//   全体のフラグと出力先はプロセス全体で共通（Stack ごとには持たない）
+// ----------------------------------------------------------------------------
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// ダンプ出力の状態
+type dumpState struct {
+	protocols      sync.Map // NetProtocolType → bool
+	upperProtocols sync.Map // IPUpperProtocolType → bool
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// 全体の16進ダンプ出力の有効/無効を設定する（既定は無効）
+func SetDump(enable bool) {
+	util.SetDumpEnabled(enable)
+}
+
+// 16進ダンプの出力先を設定する
+// NOTE: nil を指定した場合はログのレコードに含めて出力する（既定）
+func SetDumpWriter(w io.Writer) {
+	util.SetDumpWriter(w)
+}
+
+func (stack *Stack) SetDumpDevice(dev NetDevice, enable bool) {
+	dev.Info().dump.Store(enable)
+}
+
+func (stack *Stack) SetDumpProtocol(typ NetProtocolType, enable bool) {
+	stack.dump.protocols.Store(typ, enable)
+}
+
+func (stack *Stack) SetDumpIPUpperProtocol(typ IPUpperProtocolType, enable bool) {
+	stack.dump.upperProtocols.Store(typ, enable)
+}
+
+func dumpDevice(dev NetDevice) bool {
+	return util.DumpEnabled() || dev.Info().dump.Load()
+}
+
+func (stack *Stack) dumpProtocol(typ NetProtocolType) bool {
+	if util.DumpEnabled() {
+		return true
+	}
+	enable, ok := stack.dump.protocols.Load(typ)
+	return ok && enable.(bool)
+}
+
+func (stack *Stack) dumpIPUpperProtocol(typ IPUpperProtocolType) bool {
+	if util.DumpEnabled() {
+		return true
+	}
+	enable, ok := stack.dump.upperProtocols.Load(typ)
+	return ok && enable.(bool)
+}
+
+// デバイスとプロトコルのどちらかのフラグが有効であるか
+func (stack *Stack) dumpNet(dev NetDevice, typ NetProtocolType) bool {
+	return dumpDevice(dev) || stack.dumpProtocol(typ)
+}
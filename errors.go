@@ -0,0 +1,49 @@
+package microps
+
+import "errors"
+
+// ----------------------------------------------------------------------------
+// エラー（書籍には無い機能）
+// ----------------------------------------------------------------------------
+
+// NOTE:
+// 書籍では関数の成否のみを返すが、呼び出し元が errors.Is() で失敗の原因を判別できるように、
+// エラーを返す関数は以下のいずれかをラップして返す（ログの出力は従来通り行う）
+// ただし、デバイスのドライバが実装する NetDevice のメソッドは従来通り bool を返し、失敗は ErrDeviceIO として扱う
+
+// 登録・設定
+var (
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrAlreadyExists   = errors.New("already exists")
+	ErrNotFound        = errors.New("not found")
+	ErrNoResource      = errors.New("no resource available")
+	ErrInvalidState    = errors.New("invalid state")
+)
+
+// デバイス
+var (
+	ErrDeviceDown  = errors.New("device down")
+	ErrDeviceIO    = errors.New("device I/O error")
+	ErrMTUExceeded = errors.New("mtu exceeded")
+	ErrQueueFull   = errors.New("queue full")
+)
+
+// ARP・IP
+var (
+	ErrUnsupported   = errors.New("unsupported")
+	ErrARPIncomplete = errors.New("arp incomplete")
+	ErrNoRoute       = errors.New("no route to host")
+	ErrInvalidAddr   = errors.New("invalid address")
+	ErrTooLong       = errors.New("message too long")
+)
+
+// ソケット
+var (
+	ErrBadDescriptor = errors.New("bad descriptor")
+	ErrAddrInUse     = errors.New("address already in use")
+	ErrInterrupted   = errors.New("interrupted")
+	ErrClosed        = errors.New("connection closed")
+	ErrConnRefused   = errors.New("connection refused")
+	ErrConnReset     = errors.New("connection reset")
+	ErrTimeout       = errors.New("timed out")
+)
@@ -1,8 +1,10 @@
 package microps
 
 import (
+	"encoding/binary"
 	"fmt"
-	"os"
+	"log/slog"
+	"math/rand/v2"
 	"strconv"
 	"strings"
 
@@ -41,6 +43,16 @@ func (ether EtherAddr) String() string {
 	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", ether[0], ether[1], ether[2], ether[3], ether[4], ether[5])
 }
 
+// ローカル管理のユニキャストアドレスをランダムに生成する（書籍には無い機能）
+func etherAddrRandom() EtherAddr {
+	var addr EtherAddr
+	for i := range addr {
+		addr[i] = uint8(rand.N(256))
+	}
+	addr[0] = (addr[0] | 0x02) &^ 0x01 // U/L ビットを 1、I/G ビットを 0 にする
+	return addr
+}
+
 func ParseEtherAddr(str string) (EtherAddr, bool) {
 	hexs := strings.Split(str, ":")
 	if len(hexs) != EtherAddrLen {
@@ -62,6 +74,11 @@ func ParseEtherAddr(str string) (EtherAddr, bool) {
 	return addrs, true
 }
 
+// マルチキャストアドレス（I/G ビットが 1）であるか
+func (ether EtherAddr) IsMulticast() bool {
+	return ether[0]&0x01 > 0
+}
+
 var EtherAddrEmpty = EtherAddr{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 var EtherAddrBroadcast = EtherAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 
@@ -72,14 +89,52 @@ type EtherHdr struct {
 	Typ EtherType
 }
 
+// NOTE:
+//   以降の各ヘッダの Marshal() / Unmarshal() はバイト列とヘッダを相互に変換する（書籍には無い機能）
+//   ヘッダのフィールドはネットワークバイトオーダーの値をそのまま保持するため、
+//   バイト列とはシステムのバイトオーダー（NativeEndian）で変換する
+//   Marshal() に渡すバイト列はヘッダのサイズ以上の長さであること
+
+func (hdr *EtherHdr) Marshal(b []uint8) {
+	copy(b[0:6], hdr.Dst[:])
+	copy(b[6:12], hdr.Src[:])
+	binary.NativeEndian.PutUint16(b[12:], uint16(hdr.Typ))
+}
+
+func (hdr *EtherHdr) Unmarshal(b []uint8) bool {
+	if len(b) < EtherHdrSize {
+		return false
+	}
+	copy(hdr.Dst[:], b[0:6])
+	copy(hdr.Src[:], b[6:12])
+	hdr.Typ = EtherType(binary.NativeEndian.Uint16(b[12:]))
+	return true
+}
+
+// デバイスドライバが実装するフレーム送信関数
+type EtherTransmitFunc func(dev NetDevice, frame []uint8) bool
+
+// デバイスドライバが実装するフレーム受信関数
+// NOTE: buf に受信したフレームを格納して、そのサイズを返すこと
+type EtherReceiveFunc func(dev NetDevice, buf []uint8) (int, bool)
+
 // ----------------------------------------------------------------------------
 // メインロジック
 // ----------------------------------------------------------------------------
 
+// NOTE: 16進ダンプは全体のダンプ出力が有効な場合のみ出力する
 func EtherPrint(frame []uint8) {
+	etherPrint(frame, util.DumpEnabled())
+}
+
+func etherPrint(frame []uint8, hex bool) {
+	if !logEther.Enabled(slog.LevelDebug) && !hex {
+		return
+	}
+
 	var hdr EtherHdr
-	if !util.FromBytes(frame, &hdr) {
-		util.Errorf("FromBytes() falure")
+	if !hdr.Unmarshal(frame) {
+		logEther.Errorf("Unmarshal() failure")
 		return
 	}
 
@@ -87,7 +142,89 @@ func EtherPrint(frame []uint8) {
 	fmt.Fprintf(&sb, "        src: %s\n", hdr.Src.String())
 	fmt.Fprintf(&sb, "        dst: %s\n", hdr.Dst.String())
 	fmt.Fprintf(&sb, "       type: 0x%04x\n", util.Ntoh16(uint16(hdr.Typ)))
-	fmt.Fprintf(os.Stderr, sb.String())
+	logEther.Dump(sb.String(), frame, hex)
+}
+
+// NetDevice.Output() の宛先を Ethernet アドレスに変換する
+func etherDstAddr(dst any) (EtherAddr, bool) {
+	switch addr := dst.(type) {
+	case [netDeviceAddrLen]uint8:
+		return EtherAddr(addr[:EtherAddrLen]), true
+	case EtherAddr:
+		return addr, true
+	default:
+		return EtherAddrEmpty, false
+	}
+}
+
+// 書籍では ether_transmit_helper()
+func EtherOutputHelper(dev NetDevice, typ NetProtocolType, data []uint8, dst any, transmit EtherTransmitFunc) bool {
+	hwaddr, ok := etherDstAddr(dst)
+	if !ok {
+		logEther.Errorf("unsupported address, dev=%s", dev.Info().Name)
+		return false
+	}
+
+	hdr := EtherHdr{
+		Dst: hwaddr,
+		Src: EtherAddr(dev.Info().Addr[:EtherAddrLen]),
+		Typ: EtherType(util.Hton16(uint16(typ))),
+	}
+	// 最小フレーム長に満たない場合はパディングする
+	frame := make([]uint8, max(EtherHdrSize+len(data), EtherFrameSizeMin))
+	hdr.Marshal(frame)
+	copy(frame[EtherHdrSize:], data)
+
+	logEther.Debugf("dev=%s, type=0x%04x, len=%d", dev.Info().Name, typ, len(frame))
+	etherPrint(frame, dumpDevice(dev))
+	captureFrame(dev, frame, captureOutbound)
+
+	return transmit(dev, frame)
+}
+
+// 書籍では ether_input_helper()
+func EtherInputHelper(dev NetDevice, receive EtherReceiveFunc) bool {
+	buf := make([]uint8, EtherFrameSizeMax)
+	n, ok := receive(dev, buf)
+	if !ok {
+		logEther.Errorf("receive failure, dev=%s", dev.Info().Name)
+		return false
+	}
+	frame := buf[:n]
+
+	if len(frame) < EtherHdrSize {
+		logEther.Errorf("too short")
+		return false
+	}
+	// NOTE: 別のホスト宛てのフレームも書き出す
+	captureFrame(dev, frame, captureInbound)
+
+	var hdr EtherHdr
+	if !hdr.Unmarshal(frame) {
+		logEther.Errorf("Unmarshal() failure")
+		return false
+	}
+
+	if hdr.Dst != EtherAddr(dev.Info().Addr[:EtherAddrLen]) {
+		if hdr.Dst != EtherAddrBroadcast && !hdr.Dst.IsMulticast() {
+			// 別のホスト宛てのため無視
+			return false
+		}
+	}
+
+	logEther.Debugf("dev=%s, type=0x%04x, len=%d", dev.Info().Name, util.Ntoh16(uint16(hdr.Typ)), len(frame))
+	etherPrint(frame, dumpDevice(dev))
+
+	return dev.Info().Stack().NetInput(NetProtocolType(util.Ntoh16(uint16(hdr.Typ))), frame[EtherHdrSize:], dev) == nil
+}
 
-	util.DebugDump(frame)
+// 書籍では ether_setup_helper()
+func EtherSetup(dev NetDevice) {
+	info := dev.Info()
+	info.Typ = NetDeviceTypeEthernet
+	info.MTU = EtherPayloadSizeMax
+	info.Flags = NetDeviceFlagBroadcast | NetDeviceFlagNeedARP
+	info.Hlen = EtherHdrSize
+	info.Alen = EtherAddrLen
+	copy(info.Broadcast[:], EtherAddrBroadcast[:])
 }
@@ -0,0 +1,255 @@
+package microps
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// 仮想スイッチ（書籍には無い機能）
+//
+// NOTE:
+//   仮想リンクのデバイス（VethDevice）を接続するL2スイッチ
+//   送信元アドレスを学習して宛先のポートにだけ転送し、宛先が不明な場合やブロードキャストの場合は
+//   受信したポート以外のすべてのポートに転送（フラッディング）する
+//   転送は送信元のデバイスのルーチンで行い、受信処理は宛先のデバイスの割り込みハンドラで行う
+// ----------------------------------------------------------------------------
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+// 学習したアドレスのエージング時間の既定値
+const EtherSwitchAgingTime = 300 * time.Second
+
+// アドレステーブルのエントリ数の上限（超えた場合は学習しない）
+const EtherSwitchTableSizeMax = 1024
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// ポートの統計情報
+type EtherSwitchPortStats struct {
+	RxFrames uint64 // 接続先から受信したフレームの数
+	RxBytes  uint64
+	TxFrames uint64 // 接続先に送信したフレームの数
+	TxBytes  uint64
+	Floods   uint64 // 受信したフレームのうちフラッディングしたものの数
+	Filtered uint64 // 受信したフレームのうち宛先が受信したポートのため破棄したものの数
+}
+
+// スイッチのポート
+type etherSwitchPort struct {
+	sw    *EtherSwitch
+	index int
+	dev   *VethDevice // 接続先
+	stats EtherSwitchPortStats
+}
+
+// 接続先から送信されたフレームを受信する
+func (port *etherSwitchPort) receive(frame []uint8) {
+	port.sw.forward(port, frame)
+}
+
+// アドレステーブルのエントリ
+type etherSwitchEntry struct {
+	port      *etherSwitchPort
+	timestamp time.Time
+}
+
+// 仮想スイッチ
+type EtherSwitch struct {
+	aging time.Duration
+	mutex sync.Mutex
+	ports []*etherSwitchPort // 切断したポートは nil にする
+	table map[EtherAddr]*etherSwitchEntry
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// NOTE: aging に 0 を指定した場合は既定値（EtherSwitchAgingTime）を使用する
+func NewEtherSwitch(aging time.Duration) *EtherSwitch {
+	if aging == 0 {
+		aging = EtherSwitchAgingTime
+	}
+	return &EtherSwitch{
+		aging: aging,
+		table: make(map[EtherAddr]*etherSwitchEntry),
+	}
+}
+
+// デバイスを接続して、ポート番号を返す
+func (sw *EtherSwitch) Attach(dev NetDevice) (int, error) {
+	veth, ok := dev.(*VethDevice)
+	if !ok {
+		logEther.Errorf("not veth device, dev=%s", dev.Info().Name)
+		return 0, fmt.Errorf("%w: not veth device, dev=%s", ErrInvalidArgument, dev.Info().Name)
+	}
+
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	port := &etherSwitchPort{sw: sw, index: len(sw.ports), dev: veth}
+	if !veth.connect(port) {
+		logEther.Errorf("already connected, dev=%s", veth.Name)
+		return 0, fmt.Errorf("%w: already connected, dev=%s", ErrInvalidState, veth.Name)
+	}
+	sw.ports = append(sw.ports, port)
+
+	logEther.Infof("attached, dev=%s, port=%d", veth.Name, port.index)
+	return port.index, nil
+}
+
+// ポートからデバイスを切断して、そのポートで学習したアドレスを削除する
+func (sw *EtherSwitch) Detach(index int) error {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	port := sw.port(index)
+	if port == nil {
+		logEther.Errorf("port not found, port=%d", index)
+		return fmt.Errorf("%w, port=%d", ErrNotFound, index)
+	}
+	port.dev.disconnect()
+	sw.ports[index] = nil
+	for addr, entry := range sw.table {
+		if entry.port == port {
+			delete(sw.table, addr)
+		}
+	}
+
+	logEther.Infof("detached, dev=%s, port=%d", port.dev.Name, index)
+	return nil
+}
+
+// NOTE: sw.mutex をロックした状態で呼び出すこと
+func (sw *EtherSwitch) port(index int) *etherSwitchPort {
+	if index < 0 || len(sw.ports) <= index {
+		return nil
+	}
+	return sw.ports[index]
+}
+
+// ポートの統計情報
+func (sw *EtherSwitch) PortStats(index int) (EtherSwitchPortStats, error) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	port := sw.port(index)
+	if port == nil {
+		return EtherSwitchPortStats{}, fmt.Errorf("%w, port=%d", ErrNotFound, index)
+	}
+	return port.stats, nil
+}
+
+// 学習したアドレスのポート番号
+func (sw *EtherSwitch) Lookup(addr EtherAddr) (int, bool) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	port := sw.lookup(addr, time.Now())
+	if port == nil {
+		return 0, false
+	}
+	return port.index, true
+}
+
+// NOTE: sw.mutex をロックした状態で呼び出すこと
+func (sw *EtherSwitch) lookup(addr EtherAddr, now time.Time) *etherSwitchPort {
+	entry, ok := sw.table[addr]
+	if !ok {
+		return nil
+	}
+	if sw.aging < now.Sub(entry.timestamp) {
+		// エージング時間を過ぎたエントリは削除する
+		logEther.Debugf("aged out, addr=%s, port=%d", addr.String(), entry.port.index)
+		delete(sw.table, addr)
+		return nil
+	}
+	return entry.port
+}
+
+// NOTE: sw.mutex をロックした状態で呼び出すこと
+func (sw *EtherSwitch) learn(addr EtherAddr, port *etherSwitchPort, now time.Time) {
+	if addr.IsMulticast() {
+		// マルチキャスト・ブロードキャストのアドレスは送信元にならないため学習しない
+		return
+	}
+
+	if entry, ok := sw.table[addr]; ok {
+		if entry.port != port {
+			logEther.Debugf("moved, addr=%s, port=%d => %d", addr.String(), entry.port.index, port.index)
+			entry.port = port
+		}
+		entry.timestamp = now
+		return
+	}
+
+	if EtherSwitchTableSizeMax <= len(sw.table) {
+		// 期限切れのエントリを削除しても空きが無い場合は学習しない
+		for a, entry := range sw.table {
+			if sw.aging < now.Sub(entry.timestamp) {
+				delete(sw.table, a)
+			}
+		}
+		if EtherSwitchTableSizeMax <= len(sw.table) {
+			logEther.Debugf("table is full, addr=%s", addr.String())
+			return
+		}
+	}
+	sw.table[addr] = &etherSwitchEntry{port: port, timestamp: now}
+	logEther.Debugf("learned, addr=%s, port=%d", addr.String(), port.index)
+}
+
+// 受信したフレームを転送する
+func (sw *EtherSwitch) forward(in *etherSwitchPort, frame []uint8) {
+	var hdr EtherHdr
+	if !hdr.Unmarshal(frame) {
+		logEther.Errorf("Unmarshal() failure")
+		return
+	}
+	now := time.Now()
+
+	sw.mutex.Lock()
+	if sw.port(in.index) != in {
+		// 切断されたポート
+		sw.mutex.Unlock()
+		return
+	}
+	in.stats.RxFrames++
+	in.stats.RxBytes += uint64(len(frame))
+
+	sw.learn(hdr.Src, in, now)
+
+	var outs []*etherSwitchPort
+	if out := sw.lookup(hdr.Dst, now); out != nil {
+		if out == in {
+			// 宛先が同じポートにあるため転送しない
+			in.stats.Filtered++
+		} else {
+			outs = append(outs, out)
+		}
+	} else {
+		// 宛先が不明な場合やブロードキャスト・マルチキャストの場合はフラッディングする
+		in.stats.Floods++
+		for _, port := range sw.ports {
+			if port != nil && port != in {
+				outs = append(outs, port)
+			}
+		}
+	}
+	for _, out := range outs {
+		out.stats.TxFrames++
+		out.stats.TxBytes += uint64(len(frame))
+	}
+	sw.mutex.Unlock()
+
+	// NOTE: 宛先のデバイスのロックを取得するため、スイッチのロックを解放してから渡す
+	for _, out := range outs {
+		out.dev.receive(frame)
+	}
+}
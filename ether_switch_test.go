@@ -0,0 +1,150 @@
+package microps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+// NOTE: 試験用のホストなどは veth_test.go に定義している
+
+// スイッチに接続したデバイスから frame を送信して、各ポートの先のデバイスが受信したフレームの数を返す
+// NOTE: デバイスは Open() するだけで NetRun() しないため、受信したフレームは受信キューに残る
+func testSwitchSend(t *testing.T, devs []NetDevice, from int, dst EtherAddr) []int {
+	t.Helper()
+
+	var src EtherAddr
+	copy(src[:], devs[from].Info().Addr[:EtherAddrLen])
+	hdr := EtherHdr{
+		Dst: dst,
+		Src: src,
+		Typ: EtherType(util.Hton16(uint16(EtherTypeIP))),
+	}
+	frame := make([]uint8, EtherFrameSizeMin)
+	hdr.Marshal(frame)
+	vethTransmit(devs[from], frame)
+
+	received := make([]int, len(devs))
+	for i, dev := range devs {
+		for {
+			if _, ok := dev.(*VethDevice).dequeue(); !ok {
+				break
+			}
+			received[i]++
+		}
+	}
+	return received
+}
+
+func testSwitchAssertReceived(t *testing.T, got []int, want []int) {
+	t.Helper()
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("received = %v, want %v", got, want)
+			return
+		}
+	}
+}
+
+func TestEtherSwitch(t *testing.T) {
+	testLogQuiet(t)
+
+	const aging = 100 * time.Millisecond
+
+	stack := New(Options{})
+	sw := NewEtherSwitch(aging)
+	addrs := []string{"00:00:5e:00:53:01", "00:00:5e:00:53:02", "00:00:5e:00:53:03"}
+	var devs []NetDevice
+	var hwaddrs []EtherAddr
+	for i, addr := range addrs {
+		dev, err := stack.VethInit(addr)
+		if err != nil {
+			t.Fatalf("VethInit() failure: %v", err)
+		}
+		if !dev.Open() {
+			t.Fatalf("Open() failure, dev=%s", dev.Info().Name)
+		}
+		port, err := sw.Attach(dev)
+		if err != nil {
+			t.Fatalf("Attach() failure: %v", err)
+		}
+		if port != i {
+			t.Fatalf("Attach() = %d, want %d", port, i)
+		}
+		ha, _ := ParseEtherAddr(addr)
+		devs = append(devs, dev)
+		hwaddrs = append(hwaddrs, ha)
+	}
+	unknown, _ := ParseEtherAddr("00:00:5e:00:53:ff")
+
+	// ブロードキャストは受信したポート以外にフラッディングして、送信元を学習する
+	testSwitchAssertReceived(t, testSwitchSend(t, devs, 0, EtherAddrBroadcast), []int{0, 1, 1})
+	if port, ok := sw.Lookup(hwaddrs[0]); !ok || port != 0 {
+		t.Errorf("Lookup(%s) = %d, %t, want 0", hwaddrs[0].String(), port, ok)
+	}
+
+	// 学習したアドレス宛ては、そのポートにだけ転送する
+	testSwitchAssertReceived(t, testSwitchSend(t, devs, 1, hwaddrs[0]), []int{1, 0, 0})
+
+	// 学習していないアドレス宛てはフラッディングする
+	testSwitchAssertReceived(t, testSwitchSend(t, devs, 2, unknown), []int{1, 1, 0})
+
+	// 宛先が受信したポートにある場合は転送しない
+	testSwitchAssertReceived(t, testSwitchSend(t, devs, 1, hwaddrs[1]), []int{0, 0, 0})
+
+	// エージング時間を過ぎたアドレスは削除され、再びフラッディングする
+	time.Sleep(2 * aging)
+	if port, ok := sw.Lookup(hwaddrs[0]); ok {
+		t.Errorf("Lookup(%s) = %d, want aged out", hwaddrs[0].String(), port)
+	}
+	testSwitchAssertReceived(t, testSwitchSend(t, devs, 1, hwaddrs[0]), []int{1, 0, 1})
+
+	frameSize := uint64(EtherFrameSizeMin)
+	wants := []EtherSwitchPortStats{
+		{RxFrames: 1, RxBytes: 1 * frameSize, TxFrames: 3, TxBytes: 3 * frameSize, Floods: 1},
+		{RxFrames: 3, RxBytes: 3 * frameSize, TxFrames: 2, TxBytes: 2 * frameSize, Floods: 1, Filtered: 1},
+		{RxFrames: 1, RxBytes: 1 * frameSize, TxFrames: 2, TxBytes: 2 * frameSize, Floods: 1},
+	}
+	for i, want := range wants {
+		stats, err := sw.PortStats(i)
+		if err != nil {
+			t.Fatalf("PortStats() failure: %v", err)
+		}
+		if stats != want {
+			t.Errorf("PortStats(%d) = %+v, want %+v", i, stats, want)
+		}
+	}
+}
+
+// スイッチで接続した３つの Stack の間で通信できる
+func TestEtherSwitchHosts(t *testing.T) {
+	testLogQuiet(t)
+
+	sw := NewEtherSwitch(EtherSwitchAgingTime)
+	hosts := []*testHost{
+		newTestHost(t, "192.0.2.1"),
+		newTestHost(t, "192.0.2.2"),
+		newTestHost(t, "192.0.2.3"),
+	}
+	for _, host := range hosts {
+		if _, err := sw.Attach(host.dev); err != nil {
+			t.Fatalf("Attach() failure: %v", err)
+		}
+		host.run(t)
+	}
+
+	testARPResolve(t, hosts[0], hosts[2])
+	testUDPEcho(t, hosts[0], hosts[2])
+	testARPResolve(t, hosts[2], hosts[1])
+	testTCPTransfer(t, hosts[2], hosts[1], 64*1024)
+
+	// 通信したホストのアドレスを学習している
+	for i, host := range hosts {
+		port, ok := sw.Lookup(host.hwaddr())
+		if !ok || port != i {
+			t.Errorf("Lookup(%s) = %d, %t, want %d", host.hwaddr().String(), port, ok, i)
+		}
+	}
+}
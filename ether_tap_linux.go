@@ -0,0 +1,259 @@
+package microps
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+// TAP デバイスファイル
+const etherTapCloneDevice = "/dev/net/tun"
+
+// 受信キューの長さの上限（超えた場合は破棄する）
+const EtherTapQueueSizeMax = 256
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// ネットインタフェース設定用の構造体（フラグ）
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]uint8
+	flags uint16
+	_     [22]uint8 // 共用体のサイズに合わせる
+}
+
+// ネットインタフェース設定用の構造体（ハードウェアアドレス）
+type ifreqHWAddr struct {
+	name   [syscall.IFNAMSIZ]uint8
+	family uint16
+	data   [14]uint8
+	_      [8]uint8 // 共用体のサイズに合わせる
+}
+
+// Ethernet TAP デバイス
+type EtherTapDevice struct {
+	NetDeviceInfo
+	name  string // ホスト側のTAPデバイス名
+	irq   IntrIRQ
+	file  *os.File
+	mutex sync.Mutex
+	queue [][]uint8 // 受信済みフレームのキュー
+	drops uint64    // キューが溢れて破棄したフレームの数
+}
+
+func (dev *EtherTapDevice) Info() *NetDeviceInfo {
+	return &dev.NetDeviceInfo
+}
+
+// 書籍では ether_tap_open()
+func (dev *EtherTapDevice) Open() bool {
+	// NOTE:
+	//   os.OpenFile() でオープンして Fd() を呼び出すとブロッキングモードになり、
+	//   Close() で Read() のブロックを解除できなくなるため、ノンブロッキングの fd から os.File を作成する
+	fd, err := syscall.Open(etherTapCloneDevice, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		logEther.Errorf("open: %s, dev=%s", err.Error(), dev.Name)
+		return false
+	}
+
+	var ifr ifreqFlags
+	copy(ifr.name[:], dev.name)
+	ifr.flags = syscall.IFF_TAP | syscall.IFF_NO_PI
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		logEther.Errorf("ioctl [TUNSETIFF]: %s, dev=%s", errno.Error(), dev.Name)
+		syscall.Close(fd)
+		return false
+	}
+
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		logEther.Errorf("SetNonblock: %s, dev=%s", err.Error(), dev.Name)
+		syscall.Close(fd)
+		return false
+	}
+	dev.file = os.NewFile(uintptr(fd), dev.name)
+
+	if dev.Addr == [netDeviceAddrLen]uint8{} {
+		// アドレスが未指定の場合はホスト側のアドレスを借用する
+		if !dev.hwaddr() {
+			logEther.Errorf("hwaddr() failure, dev=%s", dev.Name)
+			dev.file.Close()
+			return false
+		}
+	}
+
+	go dev.reader(dev.file)
+
+	return true
+}
+
+// 書籍では ether_tap_close()
+func (dev *EtherTapDevice) Close() bool {
+	// Close() によって受信ルーチンの Read() が解除される
+	if err := dev.file.Close(); err != nil {
+		logEther.Errorf("close: %s, dev=%s", err.Error(), dev.Name)
+		return false
+	}
+	return true
+}
+
+// 書籍では ether_tap_transmit()
+func (dev *EtherTapDevice) Output(typ NetProtocolType, data []uint8, dst any) bool {
+	return EtherOutputHelper(dev, typ, data, dst, etherTapWrite)
+}
+
+// 受信キューが溢れて破棄したフレームの数
+func (dev *EtherTapDevice) Drops() uint64 {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	return dev.drops
+}
+
+// ホスト側のTAPデバイスのハードウェアアドレスを取得する
+// 書籍では ether_tap_addr()
+func (dev *EtherTapDevice) hwaddr() bool {
+	soc, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		logEther.Errorf("socket: %s, dev=%s", err.Error(), dev.Name)
+		return false
+	}
+	defer syscall.Close(soc)
+
+	var ifr ifreqHWAddr
+	copy(ifr.name[:], dev.name)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(soc), syscall.SIOCGIFHWADDR, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		logEther.Errorf("ioctl [SIOCGIFHWADDR]: %s, dev=%s", errno.Error(), dev.Name)
+		return false
+	}
+	copy(dev.Addr[:], ifr.data[:EtherAddrLen])
+
+	logEther.Infof("get hwaddr from %s, addr=%s", dev.name, EtherAddr(dev.Addr[:EtherAddrLen]).String())
+	return true
+}
+
+// 受信ルーチン
+// NOTE: 書籍ではシグナル駆動I/O（F_SETSIG）で受信を通知するが、
+// Go ではブロッキング読み込みを行うルーチンを用意して、受信したらIRQを発生させる
+func (dev *EtherTapDevice) reader(file *os.File) {
+	for {
+		buf := make([]uint8, EtherFrameSizeMax)
+		n, err := file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				logEther.Errorf("read: %s, dev=%s", err.Error(), dev.Name)
+			}
+			return
+		}
+
+		dev.mutex.Lock()
+		if EtherTapQueueSizeMax <= len(dev.queue) {
+			dev.drops++
+			dev.mutex.Unlock()
+			logEther.Errorf("queue is full, dev=%s", dev.Name)
+			continue
+		}
+		dev.queue = append(dev.queue, buf[:n])
+		dev.mutex.Unlock()
+
+		dev.stack.intrRaise(dev.irq)
+	}
+}
+
+// 未処理のフレームが存在するか
+func (dev *EtherTapDevice) pending() bool {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	return len(dev.queue) > 0
+}
+
+// 受信済みのフレームを１つ取り出す
+func (dev *EtherTapDevice) dequeue() ([]uint8, bool) {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	if len(dev.queue) == 0 {
+		return nil, false
+	}
+	frame := dev.queue[0]
+	dev.queue = dev.queue[1:]
+	return frame, true
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// 書籍では ether_tap_write()
+func etherTapWrite(dev NetDevice, frame []uint8) bool {
+	tap := dev.(*EtherTapDevice)
+	if _, err := tap.file.Write(frame); err != nil {
+		logEther.Errorf("write: %s, dev=%s", err.Error(), tap.Name)
+		return false
+	}
+	return true
+}
+
+// 書籍では ether_tap_read()
+func etherTapRead(dev NetDevice, buf []uint8) (int, bool) {
+	tap := dev.(*EtherTapDevice)
+	frame, ok := tap.dequeue()
+	if !ok {
+		return 0, false
+	}
+	return copy(buf, frame), true
+}
+
+// 割り込みハンドラ
+// 書籍では ether_tap_isr()
+func etherTapISR(irq IntrIRQ, dev NetDevice) {
+	tap, ok := dev.(*EtherTapDevice)
+	if !ok {
+		logEther.Errorf("not TAP device, dev=%s", dev.Info().Name)
+		return
+	}
+
+	// IRQ はまとめて通知されることがあるため、キューが空になるまで処理する
+	for tap.pending() {
+		EtherInputHelper(tap, etherTapRead)
+	}
+}
+
+// NOTE: addr に空文字列を指定した場合はホスト側のTAPデバイスのアドレスを使用する
+func (stack *Stack) EtherTapInit(name string, addr string) (NetDevice, error) {
+	dev := EtherTapDevice{
+		name: name,
+		irq:  stack.intrIRQAlloc(),
+	}
+	EtherSetup(&dev)
+
+	if addr != "" {
+		hwaddr, ok := ParseEtherAddr(addr)
+		if !ok {
+			logEther.Errorf("ParseEtherAddr() failure, addr=%s", addr)
+			return nil, fmt.Errorf("%w, addr=%s", ErrInvalidAddr, addr)
+		}
+		copy(dev.Addr[:], hwaddr[:])
+	}
+
+	if err := stack.NetDeviceRegister(&dev); err != nil {
+		logEther.Errorf("NetDeviceRegister() failure")
+		return nil, err
+	}
+
+	if err := stack.intrRegister(dev.irq, etherTapISR, IntrIRQFlagShared, &dev); err != nil {
+		logEther.Errorf("intrRegister() failure, dev=%s", dev.Name)
+		return nil, err
+	}
+
+	logEther.Infof("ethernet device initialized, dev=%s", dev.Name)
+	return &dev, nil
+}
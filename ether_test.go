@@ -0,0 +1,48 @@
+package microps
+
+import (
+	"testing"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+func TestEtherHdrMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  EtherHdr
+		wire []uint8
+	}{
+		{
+			name: "broadcast ARP",
+			hdr: EtherHdr{
+				Dst: EtherAddrBroadcast,
+				Src: EtherAddr{0x00, 0x00, 0x5e, 0x00, 0x53, 0x01},
+				Typ: EtherType(util.Hton16(uint16(EtherTypeARP))),
+			},
+			wire: []uint8{
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0x00, 0x00, 0x5e, 0x00, 0x53, 0x01,
+				0x08, 0x06,
+			},
+		},
+		{
+			name: "unicast IP",
+			hdr: EtherHdr{
+				Dst: EtherAddr{0x00, 0x00, 0x5e, 0x00, 0x53, 0x02},
+				Src: EtherAddr{0x00, 0x00, 0x5e, 0x00, 0x53, 0x01},
+				Typ: EtherType(util.Hton16(uint16(EtherTypeIP))),
+			},
+			wire: []uint8{
+				0x00, 0x00, 0x5e, 0x00, 0x53, 0x02,
+				0x00, 0x00, 0x5e, 0x00, 0x53, 0x01,
+				0x08, 0x00,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHdrRoundTrip(t, &tt.hdr, &EtherHdr{}, tt.wire)
+		})
+	}
+}
@@ -1,10 +1,10 @@
 package microps
 
 import (
+	"encoding/binary"
 	"fmt"
-	"os"
+	"log/slog"
 	"strings"
-	"unsafe"
 
 	"github.com/bugph0bia/go-microps/internal/util"
 )
@@ -13,6 +13,7 @@ import (
 // 定数
 // ----------------------------------------------------------------------------
 
+const ICMPHdrSize = 8
 const ICMPBufSize = IPPayloadSizeMax
 
 // ICMPメッセージ種別
@@ -58,6 +59,22 @@ const (
 	ICMPCodeSourceRouteFailed
 )
 
+// ICMPコード種別（Time Exceeded）
+const (
+	ICMPCodeExceededTTL      ICMPCode = 0 // time to live exceeded in transit
+	ICMPCodeExceededFragment ICMPCode = 1 // fragment reassembly time exceeded
+)
+
+// エラーメッセージの種別であるか
+func (typ ICMPType) IsError() bool {
+	switch typ {
+	case ICMPTypeDestUnreach, ICMPTypeSourceQuench, ICMPTypeRedirect, ICMPTypeTimeExceeded, ICMPTypeParamProblem:
+		return true
+	default:
+		return false
+	}
+}
+
 func (typ ICMPType) String() string {
 	if str, ok := icmpTypeStrings[typ]; ok {
 		return str
@@ -80,32 +97,29 @@ func (proto *ICMPProtocol) Info() *IPUpperProtocolInfo {
 }
 
 // 書籍では icmp_input()
-func (proto *ICMPProtocol) InputHandler(ipHdr *IPHdr, data []uint8, ipIface *IPIface) {
-	hdrSize := int(unsafe.Sizeof(ICMPHdr{}))
-	if len(data) < hdrSize {
-		util.Errorf("too short")
+func (proto *ICMPProtocol) InputHandler(ipHdr *IPHdr, data []uint8, packet []uint8, ipIface *IPIface) {
+	if len(data) < ICMPHdrSize {
+		logICMP.Errorf("too short")
 		return
 	}
 
-	c, ok := util.Cksum16(data, len(data), 0)
-	if !ok || c != 0 {
-		util.Errorf("checksum error")
+	if util.Cksum16(data, 0) != 0 {
+		logICMP.Errorf("checksum error")
 		return
 	}
 
-	util.Debugf("%s => %s, len=%d", ipHdr.Src.String(), ipHdr.Dst.String(), len(data))
-	util.DebugDump(data)
-	ICMPPrint(data)
+	logICMP.Debugf("%s => %s, len=%d", ipHdr.Src.String(), ipHdr.Dst.String(), len(data))
+	icmpPrint(data, proto.stack.dumpIPUpperProtocol(IPUpperProtocolTypeICMP))
 
 	var hdr ICMPHdr
-	if !util.FromBytes(data, &hdr) {
-		util.Errorf("FromBytes() failure")
+	if !hdr.Unmarshal(data) {
+		logICMP.Errorf("Unmarshal() failure")
 		return
 	}
 	switch hdr.Typ {
 	case ICMPTypeEcho:
 		// 受信したインタフェースのアドレスを含めた応答
-		ICMPOutput(ICMPTypeEchoReply, hdr.Code, hdr.Dep, data[hdrSize:], ipIface.unicast, ipHdr.Src)
+		proto.stack.ICMPOutput(ICMPTypeEchoReply, hdr.Code, hdr.Dep, data[ICMPHdrSize:], ipIface.unicast, ipHdr.Src)
 	default:
 		// 無視
 	}
@@ -118,12 +132,41 @@ type ICMPCommon struct {
 	Sum  uint16
 }
 
+func (hdr *ICMPCommon) Marshal(b []uint8) {
+	b[0] = uint8(hdr.Typ)
+	b[1] = uint8(hdr.Code)
+	binary.NativeEndian.PutUint16(b[2:], hdr.Sum)
+}
+
+func (hdr *ICMPCommon) Unmarshal(b []uint8) bool {
+	if len(b) < ICMPHdrSize {
+		return false
+	}
+	hdr.Typ = ICMPType(b[0])
+	hdr.Code = ICMPCode(b[1])
+	hdr.Sum = binary.NativeEndian.Uint16(b[2:])
+	return true
+}
+
 // ICMPヘッダ
 type ICMPHdr struct {
 	ICMPCommon
 	Dep uint32 // message dependent field
 }
 
+func (hdr *ICMPHdr) Marshal(b []uint8) {
+	hdr.ICMPCommon.Marshal(b)
+	binary.NativeEndian.PutUint32(b[4:], hdr.Dep)
+}
+
+func (hdr *ICMPHdr) Unmarshal(b []uint8) bool {
+	if !hdr.ICMPCommon.Unmarshal(b) {
+		return false
+	}
+	hdr.Dep = binary.NativeEndian.Uint32(b[4:])
+	return true
+}
+
 // ICMPヘッダ（Echo / Echo Reply）
 type ICMPEcho struct {
 	ICMPCommon
@@ -131,21 +174,58 @@ type ICMPEcho struct {
 	Seq uint16
 }
 
+func (hdr *ICMPEcho) Marshal(b []uint8) {
+	hdr.ICMPCommon.Marshal(b)
+	binary.NativeEndian.PutUint16(b[4:], hdr.ID)
+	binary.NativeEndian.PutUint16(b[6:], hdr.Seq)
+}
+
+func (hdr *ICMPEcho) Unmarshal(b []uint8) bool {
+	if !hdr.ICMPCommon.Unmarshal(b) {
+		return false
+	}
+	hdr.ID = binary.NativeEndian.Uint16(b[4:])
+	hdr.Seq = binary.NativeEndian.Uint16(b[6:])
+	return true
+}
+
 // ICMPヘッダ（Destination Unreacheble）
 type ICMPDestUnreach struct {
 	ICMPCommon
 	Unused uint32
 }
 
+func (hdr *ICMPDestUnreach) Marshal(b []uint8) {
+	hdr.ICMPCommon.Marshal(b)
+	binary.NativeEndian.PutUint32(b[4:], hdr.Unused)
+}
+
+func (hdr *ICMPDestUnreach) Unmarshal(b []uint8) bool {
+	if !hdr.ICMPCommon.Unmarshal(b) {
+		return false
+	}
+	hdr.Unused = binary.NativeEndian.Uint32(b[4:])
+	return true
+}
+
 // ----------------------------------------------------------------------------
 // メインロジック
 // ----------------------------------------------------------------------------
 
+// NOTE: 16進ダンプは全体のダンプ出力が有効な場合のみ出力する
 func ICMPPrint(data []uint8) {
+	icmpPrint(data, util.DumpEnabled())
+}
+
+func icmpPrint(data []uint8, hex bool) {
+	if !logICMP.Enabled(slog.LevelDebug) && !hex {
+		return
+	}
+
 	// data を IPHdr に変換
 	var hdr ICMPHdr
-	if !util.FromBytes(data, &hdr) {
-		util.Errorf("FromBytes() failure")
+	if !hdr.Unmarshal(data) {
+		logICMP.Errorf("Unmarshal() failure")
 		return
 	}
 
@@ -160,8 +240,8 @@ func ICMPPrint(data []uint8) {
 
 	case ICMPTypeEcho:
 		var echo ICMPEcho
-		if !util.FromBytes(data, &echo) {
-			util.Errorf("FromBytes() falure")
+		if !echo.Unmarshal(data) {
+			logICMP.Errorf("Unmarshal() failure")
 			return
 		}
 		fmt.Fprintf(&sb, "         id: %d\n", util.Ntoh16(echo.ID))
@@ -169,8 +249,8 @@ func ICMPPrint(data []uint8) {
 
 	case ICMPTypeDestUnreach:
 		var unreach ICMPDestUnreach
-		if !util.FromBytes(data, &unreach) {
-			util.Errorf("FromBytes() falure")
+		if !unreach.Unmarshal(data) {
+			logICMP.Errorf("Unmarshal() failure")
 			return
 		}
 		fmt.Fprintf(&sb, "     unused: %d\n", util.Ntoh16(uint16(unreach.Unused)))
@@ -179,11 +259,10 @@ func ICMPPrint(data []uint8) {
 		fmt.Fprintf(&sb, "        dep: 0x%08x\n", util.Ntoh16(uint16(hdr.Dep)))
 	}
 
-	util.DebugDump(data)
-	fmt.Fprintf(os.Stderr, sb.String())
+	logICMP.Dump(sb.String(), data, hex)
 }
 
-func ICMPOutput(typ ICMPType, code ICMPCode, val uint32, data []uint8, src IPAddr, dst IPAddr) bool {
+func (stack *Stack) ICMPOutput(typ ICMPType, code ICMPCode, val uint32, data []uint8, src IPAddr, dst IPAddr) error {
 	hdr := ICMPHdr{
 		ICMPCommon: ICMPCommon{
 			Typ:  typ,
@@ -193,45 +272,33 @@ func ICMPOutput(typ ICMPType, code ICMPCode, val uint32, data []uint8, src IPAdd
 		Dep: val,
 	}
 
-	if ICMPBufSize < int(unsafe.Sizeof(hdr))+len(data) {
-		util.Errorf("too large")
-		return false
+	if ICMPBufSize < ICMPHdrSize+len(data) {
+		logICMP.Errorf("too large")
+		return fmt.Errorf("%w, len=%d", ErrTooLong, len(data))
 	}
 
-	// データ構築→チェックサム計算して格納→データ再構築
-	var buf []uint8
-	var ok bool
-	buf, ok = util.ToBytes(hdr)
-	if !ok {
-		return false
-	}
-	buf = append(buf, data...)
-	hdr.Sum, ok = util.Cksum16(buf, len(buf), 0)
-	if !ok {
-		return false
-	}
-	buf, ok = util.ToBytes(hdr)
-	if !ok {
-		return false
-	}
-	buf = append(buf, data...)
+	// ヘッダとデータを書き込んでからチェックサムを計算して格納する
+	buf := make([]uint8, ICMPHdrSize+len(data))
+	hdr.Marshal(buf)
+	copy(buf[ICMPHdrSize:], data)
+	binary.NativeEndian.PutUint16(buf[2:], util.Cksum16(buf, 0)) // チェックサム値のバイトオーダー変換は行わない
 
-	util.Debugf("%s => %s, len=%d", src.String(), dst.String(), len(buf))
-	ICMPPrint(buf)
+	logICMP.Debugf("%s => %s, len=%d", src.String(), dst.String(), len(buf))
+	icmpPrint(buf, stack.dumpIPUpperProtocol(IPUpperProtocolTypeICMP))
 
-	_, ok = IPOutput(IPUpperProtocolTypeICMP, buf, src, dst)
-	return ok
+	_, err := stack.IPOutput(IPUpperProtocolTypeICMP, buf, src, dst)
+	return err
 }
 
-func ICMPInit() bool {
-	if !IPUpperProtocolRegister(&ICMPProtocol{
+func (stack *Stack) ICMPInit() error {
+	if err := stack.IPUpperProtocolRegister(&ICMPProtocol{
 		IPUpperProtocolInfo{
 			Protocol: IPUpperProtocolTypeICMP,
 		},
-	}) {
-		util.Errorf("IPUpperProtocolRegister() failure")
-		return false
+	}); err != nil {
+		logICMP.Errorf("IPUpperProtocolRegister() failure")
+		return err
 	}
 
-	return true
+	return nil
 }
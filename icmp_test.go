@@ -0,0 +1,37 @@
+package microps
+
+import (
+	"testing"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+func TestICMPHdrMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  ICMPHdr
+		wire []uint8
+	}{
+		{
+			name: "echo",
+			hdr: ICMPHdr{
+				ICMPCommon: ICMPCommon{Typ: ICMPTypeEcho, Code: 0, Sum: util.Hton16(0x1234)},
+				Dep:        util.Hton32(0x00010002), // ID=1, Seq=2
+			},
+			wire: []uint8{0x08, 0x00, 0x12, 0x34, 0x00, 0x01, 0x00, 0x02},
+		},
+		{
+			name: "port unreachable",
+			hdr: ICMPHdr{
+				ICMPCommon: ICMPCommon{Typ: ICMPTypeDestUnreach, Code: ICMPCodePortUnreach, Sum: util.Hton16(0xabcd)},
+			},
+			wire: []uint8{0x03, 0x03, 0xab, 0xcd, 0x00, 0x00, 0x00, 0x00},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHdrRoundTrip(t, &tt.hdr, &ICMPHdr{}, tt.wire)
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package microps
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// 障害を与えるデバイス（書籍には無い機能）
+//
+// NOTE:
+//   登録済みのデバイスを包み、送信/受信するデータに損失・遅延・順序の入れ替え・重複・破損・帯域制限を与える
+//   乱数のシードを固定すると、同じ順序で同じデータを送受信した場合に同じ結果になる
+//   Loopback や仮想リンクのデバイスの前に置いて、再送や再構築の処理を試験するために使う
+// ----------------------------------------------------------------------------
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+// 帯域制限で送出を待つ時間の上限（超えた場合は破棄する）
+const ImpairRateQueueDelayMax = 1 * time.Second
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// 与える障害
+// NOTE: 確率は 0～1 で指定する（ゼロ値は障害無し）
+type ImpairParams struct {
+	Loss      float64       // 破棄する確率
+	Delay     time.Duration // 遅延時間
+	Jitter    time.Duration // 遅延時間に加える揺らぎの最大値（データの順序が入れ替わることがある）
+	Reorder   float64       // 遅延させずに後続のデータを追い越させる確率（遅延が無い場合は効果が無い）
+	Duplicate float64       // 複製する確率
+	Corrupt   float64       // 1ビットを反転させる確率
+	Rate      int           // 帯域幅（bit/s、0 の場合は制限しない）
+}
+
+// 障害を与えた結果の統計
+type ImpairStats struct {
+	Packets    uint64 // 処理したデータの数
+	Dropped    uint64 // 破棄したデータの数（帯域制限によるものを含む）
+	Duplicated uint64 // 複製したデータの数
+	Corrupted  uint64 // 破損させたデータの数
+	Reordered  uint64 // 追い越させたデータの数
+}
+
+// 送信/受信の一方向の状態
+type impairDirection struct {
+	params  ImpairParams
+	stats   ImpairStats
+	next    time.Time     // 帯域制限で次のデータを送出できる時刻
+	queue   []impairEntry // 遅延させているデータ（送出する時刻の順）
+	timer   *time.Timer
+	sending sync.Mutex // 遅延させたデータを送出する順序を保つためのロック
+}
+
+// 遅延させているデータ
+type impairEntry struct {
+	due  time.Time // 送出する時刻
+	send func()
+}
+
+// 障害を与えた後に送出するデータ
+type impairPacket struct {
+	data  []uint8
+	delay time.Duration
+}
+
+// 障害を与えるデバイス
+// NOTE: デバイス情報は包んだデバイスと共有する
+type ImpairDevice struct {
+	inner NetDevice
+	mutex sync.Mutex
+	rand  *rand.Rand
+	tx    impairDirection // 送信
+	rx    impairDirection // 受信
+}
+
+func (dev *ImpairDevice) Info() *NetDeviceInfo {
+	return dev.inner.Info()
+}
+
+func (dev *ImpairDevice) Open() bool {
+	return dev.inner.Open()
+}
+
+func (dev *ImpairDevice) Close() bool {
+	return dev.inner.Close()
+}
+
+func (dev *ImpairDevice) Output(typ NetProtocolType, data []uint8, dst any) bool {
+	ret := true
+	for _, packet := range dev.impair(&dev.tx, data) {
+		if packet.delay == 0 {
+			if !dev.inner.Output(typ, packet.data, dst) {
+				ret = false
+			}
+			continue
+		}
+		dev.schedule(&dev.tx, packet.delay, func() {
+			if !dev.inner.Output(typ, packet.data, dst) {
+				logNet.Errorf("output failure, dev=%s", dev.Info().Name)
+			}
+		})
+	}
+	// NOTE: 破棄したデータも、送信したものとして扱う
+	return ret
+}
+
+// 包んでいるデバイス
+func (dev *ImpairDevice) Inner() NetDevice {
+	return dev.inner
+}
+
+// 送信するデータに与える障害を設定する
+func (dev *ImpairDevice) SetOutput(params ImpairParams) error {
+	return dev.setParams(&dev.tx, params)
+}
+
+// 受信したデータに与える障害を設定する
+func (dev *ImpairDevice) SetInput(params ImpairParams) error {
+	return dev.setParams(&dev.rx, params)
+}
+
+// 送信/受信の統計
+func (dev *ImpairDevice) Stats() (output ImpairStats, input ImpairStats) {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	return dev.tx.stats, dev.rx.stats
+}
+
+func (dev *ImpairDevice) setParams(dir *impairDirection, params ImpairParams) error {
+	for _, p := range []float64{params.Loss, params.Reorder, params.Duplicate, params.Corrupt} {
+		if p < 0 || 1 < p {
+			logNet.Errorf("invalid probability, dev=%s, p=%v", dev.Info().Name, p)
+			return fmt.Errorf("%w: invalid probability, dev=%s, p=%v", ErrInvalidArgument, dev.Info().Name, p)
+		}
+	}
+	if params.Delay < 0 || params.Jitter < 0 || params.Rate < 0 {
+		logNet.Errorf("negative value, dev=%s, delay=%v, jitter=%v, rate=%d", dev.Info().Name, params.Delay, params.Jitter, params.Rate)
+		return fmt.Errorf("%w: negative value, dev=%s", ErrInvalidArgument, dev.Info().Name)
+	}
+
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	dir.params = params
+	dir.next = time.Time{}
+	return nil
+}
+
+// 受信したデータに障害を与えてから受信キューに格納する
+func (dev *ImpairDevice) input(typ NetProtocolType, data []uint8, src NetDevice) {
+	stack := dev.Info().Stack()
+	for _, packet := range dev.impair(&dev.rx, data) {
+		if packet.delay == 0 {
+			stack.netInput(typ, packet.data, src)
+			continue
+		}
+		dev.schedule(&dev.rx, packet.delay, func() {
+			stack.netInput(typ, packet.data, src)
+		})
+	}
+}
+
+// データに障害を与え、送出するデータとその遅延時間を返す
+// NOTE: 同じシード・同じ設定で同じ順序のデータを処理した場合に同じ結果になるように、常に同じ順序で判定する
+func (dev *ImpairDevice) impair(dir *impairDirection, data []uint8) []impairPacket {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	params := dir.params
+	dir.stats.Packets++
+
+	if dev.chance(params.Loss) {
+		dir.stats.Dropped++
+		return nil
+	}
+	copies := 1
+	if dev.chance(params.Duplicate) {
+		dir.stats.Duplicated++
+		copies = 2
+	}
+
+	now := time.Now()
+	packets := make([]impairPacket, 0, copies)
+	for range copies {
+		// 遅延させる場合や破損させる場合に備えて、呼び出し元のバッファとは別に保持する
+		packet := impairPacket{data: slices.Clone(data)}
+
+		if dev.chance(params.Corrupt) && len(packet.data) > 0 {
+			bit := dev.rand.IntN(len(packet.data) * 8)
+			packet.data[bit/8] ^= 1 << (bit % 8)
+			dir.stats.Corrupted++
+		}
+
+		packet.delay = params.Delay
+		if params.Jitter > 0 {
+			packet.delay += time.Duration(dev.rand.Int64N(int64(params.Jitter) + 1))
+		}
+		if params.Delay > 0 && dev.chance(params.Reorder) {
+			packet.delay = 0
+			dir.stats.Reordered++
+		}
+
+		if params.Rate > 0 {
+			// 前のデータを送出し終えるまで待たせる
+			start := now
+			if start.Before(dir.next) {
+				start = dir.next
+			}
+			if ImpairRateQueueDelayMax < start.Sub(now) {
+				dir.stats.Dropped++
+				continue
+			}
+			dir.next = start.Add(time.Duration(len(packet.data)) * 8 * time.Second / time.Duration(params.Rate))
+			packet.delay += dir.next.Sub(now)
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// 遅延させるデータをキューに格納する
+// NOTE: 遅延時間が同じデータの順序は入れ替えない
+func (dev *ImpairDevice) schedule(dir *impairDirection, delay time.Duration, send func()) {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	entry := impairEntry{due: time.Now().Add(delay), send: send}
+	idx, _ := slices.BinarySearchFunc(dir.queue, entry.due, func(e impairEntry, due time.Time) int {
+		// 送出する時刻が同じデータの後ろに格納する
+		if due.Before(e.due) {
+			return 1
+		}
+		return -1
+	})
+	dir.queue = slices.Insert(dir.queue, idx, entry)
+	if idx > 0 {
+		return
+	}
+
+	// 先頭のデータが変わった場合はタイマーを設定し直す
+	if dir.timer == nil {
+		dir.timer = time.AfterFunc(delay, func() { dev.flush(dir) })
+	} else {
+		dir.timer.Reset(delay)
+	}
+}
+
+// 送出する時刻になったデータを順に送出する
+func (dev *ImpairDevice) flush(dir *impairDirection) {
+	dir.sending.Lock()
+	defer dir.sending.Unlock()
+
+	dev.mutex.Lock()
+	now := time.Now()
+	n := 0
+	for n < len(dir.queue) && !now.Before(dir.queue[n].due) {
+		n++
+	}
+	entries := slices.Clone(dir.queue[:n])
+	dir.queue = slices.Delete(dir.queue, 0, n)
+	if len(dir.queue) > 0 {
+		dir.timer.Reset(dir.queue[0].due.Sub(now))
+	}
+	dev.mutex.Unlock()
+
+	// 待っている間に停止された場合は破棄する
+	if !dev.Info().Stack().NetDeviceIsUp(dev) {
+		return
+	}
+	for _, entry := range entries {
+		entry.send()
+	}
+}
+
+// 確率 p で true を返す
+func (dev *ImpairDevice) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	return dev.rand.Float64() < p
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// 登録済みのデバイスを障害を与えるデバイスで包む
+// NOTE: seed に 0 を指定した場合はランダムなシードを使用する
+// NOTE: IPインタフェースは包んだ後のデバイスに登録すること（登録済みの場合は失敗する）
+func (stack *Stack) ImpairInit(dev NetDevice, seed uint64) (*ImpairDevice, error) {
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	impair := &ImpairDevice{
+		inner: dev,
+		rand:  rand.New(rand.NewPCG(seed, seed)),
+	}
+
+	stack.net.mutex.Lock()
+	defer stack.net.mutex.Unlock()
+
+	if dev.Info().impair.Load() != nil {
+		logNet.Errorf("already impaired, dev=%s", dev.Info().Name)
+		return nil, fmt.Errorf("%w: already impaired, dev=%s", ErrAlreadyExists, dev.Info().Name)
+	}
+	idx := slices.Index(stack.net.devices, dev)
+	if idx < 0 {
+		logNet.Errorf("not registered, dev=%s", dev.Info().Name)
+		return nil, fmt.Errorf("%w: not registered, dev=%s", ErrNotFound, dev.Info().Name)
+	}
+	if len(dev.Info().ifaces) > 0 {
+		logNet.Errorf("iface already registered, dev=%s", dev.Info().Name)
+		return nil, fmt.Errorf("%w: iface already registered, dev=%s", ErrInvalidState, dev.Info().Name)
+	}
+
+	// 包んだ後のデバイスに置き換える
+	stack.net.devices[idx] = impair
+	dev.Info().impair.Store(impair)
+
+	logNet.Infof("impair device initialized, dev=%s, seed=%d", dev.Info().Name, seed)
+	return impair, nil
+}
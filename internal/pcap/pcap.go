@@ -0,0 +1,181 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// pcap ファイル（書籍には無い機能）
+//
+// NOTE:
+//   libpcap のファイル形式（https://www.tcpdump.org/manpages/pcap-savefile.5.html）の読み書きを行う
+//   読み込みはマイクロ秒/ナノ秒精度の両方とどちらのバイトオーダーにも対応し、書き込みはマイクロ秒精度のリトルエンディアンで行う
+// ----------------------------------------------------------------------------
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+// リンク種別（https://www.tcpdump.org/linktypes.html）
+type LinkType uint32
+
+const (
+	LinkTypeNull     LinkType = 0   // BSD ループバック（ホストのバイトオーダーのアドレスファミリ）
+	LinkTypeEthernet LinkType = 1   // Ethernet
+	LinkTypeRaw      LinkType = 101 // IPヘッダから始まるデータ
+	LinkTypeLoop     LinkType = 108 // OpenBSD ループバック（ネットワークバイトオーダーのアドレスファミリ）
+	LinkTypeIPv4     LinkType = 228 // IPv4 ヘッダから始まるデータ
+)
+
+// 既定のスナップ長
+const SnapLenDefault = 65535
+
+const (
+	magicMicro = 0xa1b2c3d4
+	magicNano  = 0xa1b23c4d
+
+	versionMajor = 2
+	versionMinor = 4
+
+	fileHdrSize   = 24
+	recordHdrSize = 16
+)
+
+var ErrInvalidFormat = errors.New("invalid pcap format")
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// キャプチャしたデータ
+type Record struct {
+	Time    time.Time
+	Data    []byte
+	OrigLen int // キャプチャする前のデータ長（スナップ長で切り詰められている場合は len(Data) より大きい）
+}
+
+type Reader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType LinkType
+	snapLen  int
+}
+
+type Writer struct {
+	w       io.Writer
+	snapLen int
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// ファイルヘッダを読み込んで Reader を生成する
+func NewReader(r io.Reader) (*Reader, error) {
+	var hdr [fileHdrSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%w: file header: %w", ErrInvalidFormat, err)
+	}
+
+	reader := Reader{r: r}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[0:4]) {
+		case magicMicro:
+			reader.order = order
+		case magicNano:
+			reader.order = order
+			reader.nano = true
+		default:
+			continue
+		}
+		break
+	}
+	if reader.order == nil {
+		return nil, fmt.Errorf("%w: magic=0x%08x", ErrInvalidFormat, binary.BigEndian.Uint32(hdr[0:4]))
+	}
+	if major := reader.order.Uint16(hdr[4:6]); major != versionMajor {
+		return nil, fmt.Errorf("%w: version=%d", ErrInvalidFormat, major)
+	}
+	reader.snapLen = int(reader.order.Uint32(hdr[16:20]))
+	// NOTE: 上位の４ビットは FCS の有無などに使われるため除外する
+	reader.linkType = LinkType(reader.order.Uint32(hdr[20:24]) & 0x0fffffff)
+	return &reader, nil
+}
+
+func (r *Reader) LinkType() LinkType {
+	return r.linkType
+}
+
+func (r *Reader) SnapLen() int {
+	return r.snapLen
+}
+
+// 次のデータを読み込む
+// NOTE: ファイルの終端に達した場合は io.EOF を返す
+func (r *Reader) Next() (Record, error) {
+	var hdr [recordHdrSize]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Record{}, fmt.Errorf("%w: record header: %w", ErrInvalidFormat, err)
+		}
+		return Record{}, err
+	}
+
+	sec := int64(r.order.Uint32(hdr[0:4]))
+	frac := int64(r.order.Uint32(hdr[4:8]))
+	capLen := int(r.order.Uint32(hdr[8:12]))
+	origLen := int(r.order.Uint32(hdr[12:16]))
+	if capLen > max(r.snapLen, SnapLenDefault) {
+		return Record{}, fmt.Errorf("%w: caplen=%d", ErrInvalidFormat, capLen)
+	}
+	if !r.nano {
+		frac *= int64(time.Microsecond)
+	}
+
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return Record{}, fmt.Errorf("%w: record data: %w", ErrInvalidFormat, err)
+	}
+	return Record{Time: time.Unix(sec, frac), Data: data, OrigLen: origLen}, nil
+}
+
+// ファイルヘッダを書き込んで Writer を生成する
+// NOTE: snapLen に 0 以下を指定した場合は既定のスナップ長を使用する
+func NewWriter(w io.Writer, linkType LinkType, snapLen int) (*Writer, error) {
+	if snapLen <= 0 {
+		snapLen = SnapLenDefault
+	}
+
+	var hdr [fileHdrSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], magicMicro)
+	binary.LittleEndian.PutUint16(hdr[4:6], versionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], versionMinor)
+	// thiszone と sigfigs は 0 のまま
+	binary.LittleEndian.PutUint32(hdr[16:20], uint32(snapLen))
+	binary.LittleEndian.PutUint32(hdr[20:24], uint32(linkType))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, snapLen: snapLen}, nil
+}
+
+// データを書き込む（スナップ長を超える部分は切り詰める）
+// NOTE: 並行して呼び出さないこと
+func (w *Writer) Write(t time.Time, data []byte) error {
+	capLen := min(len(data), w.snapLen)
+
+	// ヘッダとデータを１回で書き込み、ファイルに途中までのデータが残らないようにする
+	buf := make([]byte, recordHdrSize+capLen)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(t.Nanosecond()/int(time.Microsecond)))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(capLen))
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(len(data)))
+	copy(buf[recordHdrSize:], data[:capLen])
+	_, err := w.w.Write(buf)
+	return err
+}
@@ -0,0 +1,132 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// pcapng ファイル（書籍には無い機能）
+//
+// NOTE:
+//   pcapng のファイル形式（draft-ietf-opsawg-pcapng）の書き込みを行う
+//   インタフェースを１つだけ持つセクションを書き込み、データには送信/受信の向きを記録する
+// ----------------------------------------------------------------------------
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+// データの向き
+type Direction uint32
+
+const (
+	DirectionUnknown  Direction = 0
+	DirectionInbound  Direction = 1
+	DirectionOutbound Direction = 2
+)
+
+const (
+	blockTypeSHB = 0x0a0d0d0a // Section Header Block
+	blockTypeIDB = 0x00000001 // Interface Description Block
+	blockTypeEPB = 0x00000006 // Enhanced Packet Block
+
+	byteOrderMagic = 0x1a2b3c4d
+
+	optEndOfOpt  = 0
+	optIfName    = 2 // if_name
+	optIfTsresol = 9 // if_tsresol
+	optEpbFlags  = 2 // epb_flags
+)
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+type NgWriter struct {
+	w       io.Writer
+	snapLen int
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// セクションヘッダとインタフェースの情報を書き込んで NgWriter を生成する
+// NOTE: snapLen に 0 以下を指定した場合は既定のスナップ長を使用する
+func NewNgWriter(w io.Writer, linkType LinkType, snapLen int, ifName string) (*NgWriter, error) {
+	if snapLen <= 0 {
+		snapLen = SnapLenDefault
+	}
+
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, byteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)                  // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0)                  // minor version
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff) // セクションの長さは不定
+	if _, err := w.Write(ngBlock(blockTypeSHB, shb)); err != nil {
+		return nil, err
+	}
+
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, uint16(linkType))
+	idb = binary.LittleEndian.AppendUint16(idb, 0) // reserved
+	idb = binary.LittleEndian.AppendUint32(idb, uint32(snapLen))
+	if ifName != "" {
+		idb = ngAppendOption(idb, optIfName, []byte(ifName))
+	}
+	idb = ngAppendOption(idb, optIfTsresol, []byte{6}) // マイクロ秒
+	idb = ngAppendOption(idb, optEndOfOpt, nil)
+	if _, err := w.Write(ngBlock(blockTypeIDB, idb)); err != nil {
+		return nil, err
+	}
+	return &NgWriter{w: w, snapLen: snapLen}, nil
+}
+
+// データを書き込む（スナップ長を超える部分は切り詰める）
+// NOTE: 並行して呼び出さないこと
+func (w *NgWriter) Write(t time.Time, data []byte, dir Direction) error {
+	capLen := min(len(data), w.snapLen)
+	ts := uint64(t.UnixMicro())
+
+	var epb []byte
+	epb = binary.LittleEndian.AppendUint32(epb, 0) // interface id
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(capLen))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = ngAppendPadded(epb, data[:capLen])
+	if dir != DirectionUnknown {
+		epb = ngAppendOption(epb, optEpbFlags, binary.LittleEndian.AppendUint32(nil, uint32(dir)))
+		epb = ngAppendOption(epb, optEndOfOpt, nil)
+	}
+	_, err := w.w.Write(ngBlock(blockTypeEPB, epb))
+	return err
+}
+
+// ブロックの種別と長さで本体を挟む
+func ngBlock(typ uint32, body []byte) []byte {
+	length := uint32(12 + len(body))
+	block := make([]byte, 0, length)
+	block = binary.LittleEndian.AppendUint32(block, typ)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	return block
+}
+
+func ngAppendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return ngAppendPadded(b, value)
+}
+
+// ４バイト境界までパディングして追加する
+func ngAppendPadded(b []byte, data []byte) []byte {
+	b = append(b, data...)
+	if pad := (4 - len(data)%4) % 4; pad > 0 {
+		b = append(b, make([]byte, pad)...)
+	}
+	return b
+}
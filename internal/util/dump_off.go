@@ -1,6 +0,0 @@
-//go:build !HEXDUMP
-
-package util
-
-func DebugDump(data any) {
-}
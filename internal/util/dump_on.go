@@ -1,9 +0,0 @@
-//go:build HEXDUMP
-
-package util
-
-import "os"
-
-func DebugDump(data any) {
-	hexdump(os.Stderr, data)
-}
@@ -1,16 +1,20 @@
 package util
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/bits"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 	"unsafe"
@@ -18,65 +22,333 @@ import (
 
 // ----------------------------------------------------------------------------
 // ロギング
+//
+// NOTE:
+//   書籍では標準エラー出力へ直接書き出すが、log/slog のハンドラを差し替えられるようにして、
+//   サブシステム（net, ip など）ごとにログレベルを制御できるようにする（書籍には無い機能）
 // ----------------------------------------------------------------------------
 
-func Errorf(format string, a ...any) int {
-	return logf('E', format, a...)
+// 既定のロガーの名称
+const DefaultLoggerName = "microps"
+
+// レコードの属性のキー
+const (
+	LogKeySubsystem = "subsystem"
+	LogKeyFields    = "fields"  // ダンプ出力のヘッダ情報
+	LogKeyHexdump   = "hexdump" // ダンプ出力の16進ダンプ
+)
+
+// ダンプ出力のレコードのメッセージ
+const LogDumpMessage = "dump"
+
+var (
+	logHandler     atomic.Pointer[slog.Handler]
+	logLevel       slog.LevelVar // 全体のログレベル
+	stderrHandler  = NewTextHandler(os.Stderr)
+	funcNameRegexp = regexp.MustCompile(`(.+/)+.+?\.`)
+
+	loggersMutex  sync.Mutex
+	loggers       = map[string]*Logger{}
+	defaultLogger = NewLogger(DefaultLoggerName)
+)
+
+func init() {
+	// 書籍と同様に既定ではすべてのログを出力する
+	logLevel.Set(slog.LevelDebug)
 }
 
-func Warnf(format string, a ...any) int {
-	return logf('W', format, a...)
+// ログの出力先のハンドラを設定する
+// NOTE: nil を指定した場合は既定のハンドラ（標準エラー出力へのテキスト形式）に戻す
+func SetLogHandler(h slog.Handler) {
+	if h == nil {
+		logHandler.Store(nil)
+		return
+	}
+	logHandler.Store(&h)
 }
 
-func Infof(format string, a ...any) int {
-	return logf('I', format, a...)
+func handler() slog.Handler {
+	if h := logHandler.Load(); h != nil {
+		return *h
+	}
+	return stderrHandler
 }
 
-func Debugf(format string, a ...any) int {
-	return logf('D', format, a...)
+// 全体のログレベルを設定する
+// NOTE: 個別にレベルを設定したロガーには影響しない
+func SetLogLevel(level slog.Level) {
+	logLevel.Set(level)
 }
 
-func logf(level rune, format string, a ...any) int {
-	var funcName string
+func Errorf(format string, a ...any) {
+	defaultLogger.log(slog.LevelError, format, a...)
+}
 
-	// ランタイム情報から、2つ上の呼び出し元の関数情報を取得する
-	pc, fpath, line, ok := runtime.Caller(2) // この関数は直接呼び出さず、errorf などのラッパーを中継する前提
-	if !ok {
-		funcName = "Unknown"
-		fpath = "Unknown"
-		line = 0
-	} else {
-		// プログラムカウンタから関数名を取得
-		funcName = runtime.FuncForPC(pc).Name()
-		// パッケージ名を除去
-		re := regexp.MustCompile(`(.+/)+.+?\.`)
-		funcName = re.ReplaceAllString(funcName, "")
+func Warnf(format string, a ...any) {
+	defaultLogger.log(slog.LevelWarn, format, a...)
+}
+
+func Infof(format string, a ...any) {
+	defaultLogger.log(slog.LevelInfo, format, a...)
+}
+
+func Debugf(format string, a ...any) {
+	defaultLogger.log(slog.LevelDebug, format, a...)
+}
+
+// 既定のロガーでデータを16進ダンプ出力する（ダンプ出力が有効な場合のみ）
+func DebugDump(data []byte) {
+	defaultLogger.dump("", data, DumpEnabled())
+}
+
+// サブシステムごとのロガー
+type Logger struct {
+	name  string
+	level slog.LevelVar
+	own   atomic.Bool // 個別にレベルが設定されているか
+}
+
+// 同じ名称のロガーが既に存在する場合はそれを返す
+func NewLogger(name string) *Logger {
+	loggersMutex.Lock()
+	defer loggersMutex.Unlock()
+
+	if l, ok := loggers[name]; ok {
+		return l
 	}
+	l := &Logger{name: name}
+	loggers[name] = l
+	return l
+}
+
+func LookupLogger(name string) (*Logger, bool) {
+	loggersMutex.Lock()
+	defer loggersMutex.Unlock()
 
-	return lprintf(os.Stderr, level, filepath.Base(fpath), line, funcName, format, a...)
+	l, ok := loggers[name]
+	return l, ok
 }
 
-func lprintf(w io.Writer, level rune, fileName string, line int, funcName string, format string, a ...any) int {
+func (l *Logger) Name() string {
+	return l.name
+}
+
+func (l *Logger) Level() slog.Level {
+	if l.own.Load() {
+		return l.level.Level()
+	}
+	return logLevel.Level()
+}
+
+func (l *Logger) SetLevel(level slog.Level) {
+	l.level.Set(level)
+	l.own.Store(true)
+}
+
+// 個別のレベル設定を解除して全体のログレベルに従うようにする
+func (l *Logger) ResetLevel() {
+	l.own.Store(false)
+}
+
+func (l *Logger) Enabled(level slog.Level) bool {
+	return level >= l.Level() && handler().Enabled(context.Background(), level)
+}
+
+func (l *Logger) Errorf(format string, a ...any) {
+	l.log(slog.LevelError, format, a...)
+}
+
+func (l *Logger) Warnf(format string, a ...any) {
+	l.log(slog.LevelWarn, format, a...)
+}
+
+func (l *Logger) Infof(format string, a ...any) {
+	l.log(slog.LevelInfo, format, a...)
+}
+
+func (l *Logger) Debugf(format string, a ...any) {
+	l.log(slog.LevelDebug, format, a...)
+}
+
+// パケットのヘッダ情報（fields）をデバッグレベルで出力する
+// hex に true を指定した場合はデータの16進ダンプも出力する
+// NOTE: 16進ダンプの出力先（SetDumpWriter()）が指定されている場合は、ログのレベルによらずそちらに出力する
+func (l *Logger) Dump(fields string, data []byte, hex bool) {
+	l.dump(fields, data, hex)
+}
+
+func (l *Logger) log(level slog.Level, format string, a ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.output(level, fmt.Sprintf(format, a...))
+}
+
+func (l *Logger) dump(fields string, data []byte, hex bool) {
+	if hex && writeDump(data) {
+		// 16進ダンプはログとは別に出力済み
+		hex = false
+	}
+	if !l.Enabled(slog.LevelDebug) {
+		return
+	}
+
+	var attrs []slog.Attr
+	if fields != "" {
+		attrs = append(attrs, slog.String(LogKeyFields, fields))
+	}
+	if hex {
+		var sb strings.Builder
+		Hexdump(&sb, data)
+		attrs = append(attrs, slog.String(LogKeyHexdump, sb.String()))
+	}
+	if len(attrs) == 0 {
+		return
+	}
+	l.output(slog.LevelDebug, LogDumpMessage, attrs...)
+}
+
+func (l *Logger) output(level slog.Level, msg string, attrs ...slog.Attr) {
+	// 呼び出し元の関数情報を取得する
+	// NOTE: output() ← log()/dump() ← Errorf() などのラッパー ← 呼び出し元 という経路で呼び出す前提
+	var pcs [1]uintptr
+	runtime.Callers(4, pcs[:])
+
+	r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	r.AddAttrs(slog.String(LogKeySubsystem, l.name))
+	r.AddAttrs(attrs...)
+	handler().Handle(context.Background(), r)
+}
+
+// 書籍と同じ形式でテキスト出力するハンドラ
+type textHandler struct {
+	w     io.Writer
+	mutex *sync.Mutex
+	attrs []slog.Attr
+}
+
+func NewTextHandler(w io.Writer) slog.Handler {
+	return &textHandler{w: w, mutex: &sync.Mutex{}}
+}
+
+func (h *textHandler) Enabled(context.Context, slog.Level) bool {
+	// NOTE: レベルの判定は Logger で行う
+	return true
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &textHandler{w: h.w, mutex: h.mutex, attrs: append(slices.Clone(h.attrs), attrs...)}
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	// NOTE: グループは使用しないため無視する
+	return h
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
 	var sb strings.Builder
-	t := time.Now()
-	fmt.Fprintf(&sb, "%s [%c] %s: ", t.Format("15:04:05.000"), level, funcName)
-	fmt.Fprintf(&sb, format, a...)
-	fmt.Fprintf(&sb, " (%s:%d)\n", fileName, line)
 
-	n, _ := fmt.Fprintf(w, sb.String())
-	return n
+	if r.Message == LogDumpMessage {
+		// ダンプ出力は書籍と同様にそのまま出力する
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == LogKeyFields || a.Key == LogKeyHexdump {
+				sb.WriteString(a.Value.String())
+			}
+			return true
+		})
+	} else {
+		funcName, fileName, line := "Unknown", "Unknown", 0
+		if r.PC != 0 {
+			frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+			// パッケージ名を除去
+			funcName = funcNameRegexp.ReplaceAllString(frame.Function, "")
+			fileName = filepath.Base(frame.File)
+			line = frame.Line
+		}
+
+		fmt.Fprintf(&sb, "%s [%c] %s: %s", r.Time.Format("15:04:05.000"), levelRune(r.Level), funcName, r.Message)
+		appendAttr := func(a slog.Attr) bool {
+			// NOTE: サブシステム名は関数名から判別できるため省略する
+			if a.Key != LogKeySubsystem {
+				fmt.Fprintf(&sb, ", %s=%s", a.Key, a.Value.String())
+			}
+			return true
+		}
+		for _, a := range h.attrs {
+			appendAttr(a)
+		}
+		r.Attrs(appendAttr)
+		fmt.Fprintf(&sb, " (%s:%d)\n", fileName, line)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	_, err := io.WriteString(h.w, sb.String())
+	return err
+}
+
+func levelRune(level slog.Level) rune {
+	switch {
+	case level >= slog.LevelError:
+		return 'E'
+	case level >= slog.LevelWarn:
+		return 'W'
+	case level >= slog.LevelInfo:
+		return 'I'
+	default:
+		return 'D'
+	}
+}
+
+// ----------------------------------------------------------------------------
+// ダンプ
+//
+// NOTE:
+//   書籍では HEXDUMP を定義してビルドしたときだけダンプ出力するが、
+//   再ビルドせずに切り替えられるように実行時のフラグで制御する（書籍には無い機能）
+// ----------------------------------------------------------------------------
+
+var (
+	dumpEnabled    atomic.Bool
+	dumpWriterPtr  atomic.Pointer[io.Writer]
+	dumpWriteMutex sync.Mutex
+)
+
+// 全体の16進ダンプ出力の有効/無効を設定する（既定は無効）
+func SetDumpEnabled(enable bool) {
+	dumpEnabled.Store(enable)
 }
 
-func hexdump(w io.Writer, data any) {
-	// data を []byte に変換
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.NativeEndian, data)
-	if err != nil {
-		fmt.Fprintf(w, "Error: %s\n", err.Error())
+func DumpEnabled() bool {
+	return dumpEnabled.Load()
+}
+
+// 16進ダンプの出力先を設定する
+// NOTE: nil を指定した場合はログのレコードに含めて出力する
+func SetDumpWriter(w io.Writer) {
+	if w == nil {
+		dumpWriterPtr.Store(nil)
 		return
 	}
-	src := buf.Bytes()
+	dumpWriterPtr.Store(&w)
+}
+
+// 出力先が指定されている場合は16進ダンプを出力して true を返す
+func writeDump(data []byte) bool {
+	p := dumpWriterPtr.Load()
+	if p == nil {
+		return false
+	}
+
+	dumpWriteMutex.Lock()
+	defer dumpWriteMutex.Unlock()
 
+	Hexdump(*p, data)
+	return true
+}
+
+func Hexdump(w io.Writer, src []byte) {
 	var sb strings.Builder
 	fmt.Fprintln(&sb, "+------+-------------------------------------------------+------------------+")
 	for offset := 0; offset < len(src); offset += 16 {
@@ -161,61 +433,39 @@ func Ntoh32(n uint32) uint32 {
 // チェックサム
 // ----------------------------------------------------------------------------
 
-func Cksum16(data any, count int, init uint32) (uint16, bool) {
-	// data を []byte に変換
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.NativeEndian, data)
-	if err != nil {
-		Errorf(err.Error())
-		return 0, false
-	}
-
-	b := buf.Bytes()
-	// []byte を []uint16 に変換
-	addr := make([]uint16, len(b)/2)
-	for i := 0; i < len(addr); i++ {
-		addr[i] = binary.NativeEndian.Uint16(b[i*2:])
-	}
-
-	var sum uint32 = init
+// data を16ビット毎に1の補数和で init に加算して返す（書籍には無い機能）
+// 疑似ヘッダとデータのように複数のバイト列にまたがって計算する場合は、戻り値を次の呼び出しの init に渡す
+// NOTE: 途中のバイト列は偶数長であること
+// NOTE: バイト列をそのままの形で加算するため、システムのバイトオーダー（NativeEndian）を使用する
+func Sum16(data []byte, init uint32) uint32 {
+	sum := uint64(init)
 
-	i := 0
-	for count > 1 {
-		sum += uint32(addr[i])
-		i++
-		count -= 2
+	n := len(data) &^ 1
+	for i := 0; i < n; i += 2 {
+		sum += uint64(binary.NativeEndian.Uint16(data[i:]))
 	}
-	if count > 0 {
-		sum += uint32(addr[i] >> 8)
+	if len(data) > n {
+		// 奇数長の場合は末尾の1バイトを 0 でパディングして加算する
+		sum += uint64(binary.NativeEndian.Uint16([]uint8{data[n], 0x00}))
 	}
 	for (sum >> 16) > 0 {
 		sum = (sum & 0xffff) + (sum >> 16)
 	}
 
-	return ^uint16(sum), true
+	return uint32(sum)
 }
 
-// ----------------------------------------------------------------------------
-// バイトコード変換
-//
-// NOTE:
-//   バイト列をそのままの形で変換するため
-//   システムのバイトオーダー（NativeEndian）を使用する
-// ----------------------------------------------------------------------------
-
-func ToBytes(v any) ([]uint8, bool) {
-	buffer := new(bytes.Buffer)
-	if err := binary.Write(buffer, binary.NativeEndian, v); err != nil {
-		return nil, false
-	}
-	return buffer.Bytes(), true
+// NOTE: チェックサム値のバイトオーダー変換は行わないため、そのままの値をヘッダに格納すること
+func Cksum16(data []byte, init uint32) uint16 {
+	return ^uint16(Sum16(data, init))
 }
 
-// NOTE: v にはポインタ型を渡すこと
-func FromBytes(data []uint8, v any) bool {
-	reader := bytes.NewReader(data)
-	if err := binary.Read(reader, binary.NativeEndian, v); err != nil {
-		return false
+// ヘッダの16ビットの値を old から new に書き換えたときに、チェックサム sum を差分で更新する（書籍には無い機能）
+// NOTE: RFC 1624 の HC' = ~(~HC + ~m + m') で計算する
+func CksumUpdate16(sum uint16, old uint16, new uint16) uint16 {
+	s := uint32(^sum) + uint32(^old) + uint32(new)
+	for (s >> 16) > 0 {
+		s = (s & 0xffff) + (s >> 16)
 	}
-	return true
+	return ^uint16(s)
 }
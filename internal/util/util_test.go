@@ -0,0 +1,149 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// チェックサムのベンチマーク（書籍には無い機能）
+// NOTE: 比較のため、以前の encoding/binary で変換してから計算する Cksum16() と同じ処理も計測する
+
+// 以前の実装
+func cksum16Binary(data any, count int, init uint32) (uint16, bool) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.NativeEndian, data); err != nil {
+		return 0, false
+	}
+
+	b := buf.Bytes()
+	addr := make([]uint16, len(b)/2)
+	for i := 0; i < len(addr); i++ {
+		addr[i] = binary.NativeEndian.Uint16(b[i*2:])
+	}
+
+	var sum uint32 = init
+	i := 0
+	for count > 1 {
+		sum += uint32(addr[i])
+		i++
+		count -= 2
+	}
+	if count > 0 {
+		sum += uint32(binary.NativeEndian.Uint16([]uint8{b[i*2], 0x00}))
+	}
+	for (sum >> 16) > 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum), true
+}
+
+// Ethernet のペイロードの最大長のデータ
+var benchPayload = make([]uint8, 1500)
+
+// チェックサムを計算済みの IPヘッダ（オプション無し）
+func benchIPHdr() []uint8 {
+	hdr := []uint8{
+		0x45, 0x00, 0x05, 0xdc, // VHL, TOS, Total
+		0x00, 0x01, 0x00, 0x00, // ID, Offset
+		0xff, 0x06, 0x00, 0x00, // TTL, Protocol, Sum
+		0x7f, 0x00, 0x00, 0x01, // Src
+		0x7f, 0x00, 0x00, 0x01, // Dst
+	}
+	binary.NativeEndian.PutUint16(hdr[10:], Cksum16(hdr, 0))
+	return hdr
+}
+
+func BenchmarkCksum16(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		Cksum16(benchPayload, 0)
+	}
+}
+
+func BenchmarkCksum16Binary(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		cksum16Binary(benchPayload, len(benchPayload), 0)
+	}
+}
+
+// TTL を減らした後にチェックサムをすべて計算し直す
+func BenchmarkCksum16TTLDecrement(b *testing.B) {
+	b.ReportAllocs()
+	hdr := benchIPHdr()
+	for b.Loop() {
+		hdr[8]-- // TTL
+		hdr[10], hdr[11] = 0x00, 0x00
+		binary.NativeEndian.PutUint16(hdr[10:], Cksum16(hdr, 0))
+	}
+}
+
+// TTL を減らした後にチェックサムを差分で更新する
+func BenchmarkCksumUpdate16TTLDecrement(b *testing.B) {
+	b.ReportAllocs()
+	hdr := benchIPHdr()
+	for b.Loop() {
+		old := binary.NativeEndian.Uint16(hdr[8:])
+		hdr[8]-- // TTL
+		sum := CksumUpdate16(binary.NativeEndian.Uint16(hdr[10:]), old, binary.NativeEndian.Uint16(hdr[8:]))
+		binary.NativeEndian.PutUint16(hdr[10:], sum)
+	}
+}
+
+// チェックサムのテスト（書籍には無い機能）
+
+// チェックサムが正しい IPヘッダ（オプション無し）
+var testIPHdrs = []struct {
+	name string
+	hdr  []uint8
+}{
+	{"UDP", []uint8{
+		0x45, 0x00, 0x00, 0x73, // VHL, TOS, Total
+		0x00, 0x00, 0x40, 0x00, // ID, Offset
+		0x40, 0x11, 0xb8, 0x61, // TTL, Protocol, Sum
+		0xc0, 0xa8, 0x00, 0x01, // Src
+		0xc0, 0xa8, 0x00, 0xc7, // Dst
+	}},
+	{"TCP", []uint8{
+		0x45, 0x00, 0x00, 0x3c, // VHL, TOS, Total
+		0x1c, 0x46, 0x40, 0x00, // ID, Offset
+		0x40, 0x06, 0xb1, 0xe6, // TTL, Protocol, Sum
+		0xac, 0x10, 0x0a, 0x63, // Src
+		0xac, 0x10, 0x0a, 0x0c, // Dst
+	}},
+}
+
+// チェックサムを含めて計算すると 0 になる
+func TestCksum16(t *testing.T) {
+	for _, tt := range testIPHdrs {
+		t.Run(tt.name, func(t *testing.T) {
+			if sum := Cksum16(tt.hdr, 0); sum != 0 {
+				t.Errorf("Cksum16() = 0x%04x, want 0x0000", sum)
+			}
+		})
+	}
+}
+
+// TTL を減らしながら、差分で更新したチェックサムとすべて計算し直したチェックサムを比較する
+func TestCksumUpdate16(t *testing.T) {
+	for _, tt := range testIPHdrs {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := slices.Clone(tt.hdr)
+			for hdr[8] > 0 {
+				sum := binary.NativeEndian.Uint16(hdr[10:])
+				old := binary.NativeEndian.Uint16(hdr[8:])
+				hdr[8]-- // TTL
+				got := CksumUpdate16(sum, old, binary.NativeEndian.Uint16(hdr[8:]))
+
+				hdr[10], hdr[11] = 0x00, 0x00
+				want := Cksum16(hdr, 0)
+				if got != want {
+					t.Fatalf("CksumUpdate16() = 0x%04x, want 0x%04x, ttl=%d", got, want, hdr[8])
+				}
+				binary.NativeEndian.PutUint16(hdr[10:], got)
+			}
+		})
+	}
+}
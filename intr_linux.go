@@ -1,34 +1,39 @@
 package microps
 
 import (
-	"os"
-	"os/signal"
-	"syscall"
-
-	"github.com/bugph0bia/go-microps/internal/util"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
 )
 
 // ----------------------------------------------------------------------------
 // 定数
 // ----------------------------------------------------------------------------
 
-const IntrIRQBase = syscall.SIGUSR1
+// IRQ番号
+type IntrIRQ uint32
+
+const IntrIRQBase IntrIRQ = 1
 
 const (
 	IntrIRQFlagShared uint16 = 0x0001 // IRQ番号の共有を許可
 )
 
+// タイマーの周期（書籍では SIGALRM を 1ms 周期で発生させる）
+const intrTimerInterval = 1 * time.Millisecond
+
 // ----------------------------------------------------------------------------
 // データ
 // ----------------------------------------------------------------------------
 
 // 割り込みハンドラ型
-type IntrISRHandler func(sig syscall.Signal, dev NetDevice)
+type IntrISRHandler func(irq IntrIRQ, dev NetDevice)
 
 // 割り込み管理構造体
 type IRQEntry struct {
-	// 書籍ではIRQ番号を意味する irq
-	sig syscall.Signal
+	// IRQ番号
+	irq IntrIRQ
 	// 割り込みハンドラ (Interrupt Service Routine)
 	isr IntrISRHandler
 	// フラグ
@@ -37,63 +42,253 @@ type IRQEntry struct {
 	dev NetDevice
 }
 
-// NOTE: intrRun() を呼び出した後にエントリを追加/削除する場合はデバイスリストをロックすること
-var irqs []IRQEntry
+// IRQ線の状態
+type irqLine struct {
+	disabled bool // 割り込みの禁止
+	pending  bool // 未処理の割り込みの有無
+}
+
+// 割り込みの状態
+type intrState struct {
+	// NOTE: 以降の irqXxx は mutex をロックして参照すること
+	irqs     []IRQEntry
+	irqLines map[IntrIRQ]*irqLine
+	irqNext  IntrIRQ // 次に割り当てるIRQ番号
+	mutex    sync.Mutex
+
+	// NOTE:
+	// 書籍ではシグナルでIRQを通知するが、利用できるシグナルの数に制限されないようにチャネルで通知する
+	// 割り込みの発生はIRQ線ごとのフラグに記録し、割り込みルーチンがまとめて処理する
+	irqChan chan struct{}
 
-// シグナル受信用のチャネル
-var sigChan = make(chan os.Signal, 1)
+	// ソフトウェア割り込み用のチャネル
+	softirqChan chan struct{}
 
-// シグナル受信ルーチンの制御用チャネル
-var ready = make(chan struct{})     // 起動直後の同期
-var terminate = make(chan struct{}) // 終了指示
+	// イベント用のチャネル
+	eventChan chan struct{}
+
+	// 割り込みルーチンの制御用チャネル
+	terminate chan struct{} // 終了指示
+	done      chan struct{} // 終了の完了
+}
+
+func (intr *intrState) init() {
+	intr.irqLines = make(map[IntrIRQ]*irqLine)
+	intr.irqNext = IntrIRQBase
+	intr.irqChan = make(chan struct{}, 1)
+	intr.softirqChan = make(chan struct{}, 1)
+	intr.eventChan = make(chan struct{}, 1)
+}
 
 // ----------------------------------------------------------------------------
 // メインロジック
 // ----------------------------------------------------------------------------
 
-func intrRegister(sig syscall.Signal, isr IntrISRHandler, flags uint16, dev NetDevice) bool {
-	util.Debugf("sig=%s, flags=0x%04x, dev=%s", sig.String(), flags, dev.Info().Name)
+// 未使用のIRQ番号を割り当てる
+func (stack *Stack) intrIRQAlloc() IntrIRQ {
+	stack.intr.mutex.Lock()
+	defer stack.intr.mutex.Unlock()
+
+	irq := stack.intr.irqNext
+	stack.intr.irqNext++
+	return irq
+}
 
-	for _, entry := range irqs {
-		if entry.sig == sig {
+func (stack *Stack) intrRegister(irq IntrIRQ, isr IntrISRHandler, flags uint16, dev NetDevice) error {
+	logIntr.Debugf("irq=%d, flags=0x%04x, dev=%s", irq, flags, dev.Info().Name)
+
+	stack.intr.mutex.Lock()
+	defer stack.intr.mutex.Unlock()
+
+	for _, entry := range stack.intr.irqs {
+		if entry.irq == irq {
 			if (entry.flags&IntrIRQFlagShared == 0) || (flags&IntrIRQFlagShared == 0) {
-				util.Errorf("conflicts with registerd IRQs")
-				return false
+				logIntr.Errorf("conflicts with registerd IRQs")
+				return fmt.Errorf("%w: irq conflicts, irq=%d", ErrAlreadyExists, irq)
 			}
 		}
 	}
 
 	entry := IRQEntry{
-		sig:   sig,
+		irq:   irq,
 		isr:   isr,
 		flags: flags,
 		dev:   dev,
 	}
-	irqs = append(irqs, entry)
-	signal.Notify(sigChan, sig)
+	stack.intr.irqs = append(stack.intr.irqs, entry)
+	if _, ok := stack.intr.irqLines[irq]; !ok {
+		stack.intr.irqLines[irq] = &irqLine{}
+	}
+	stack.intr.irqNext = max(stack.intr.irqNext, irq+1)
 
-	util.Debugf("registerd: sig=%s, dev=%s", entry.sig.String(), entry.dev.Info().Name)
+	logIntr.Debugf("registerd: irq=%d, dev=%s", entry.irq, entry.dev.Info().Name)
+	return nil
+}
+
+// デバイスの割り込みハンドラを削除する（書籍には無い機能）
+func (stack *Stack) intrUnregister(dev NetDevice) bool {
+	stack.intr.mutex.Lock()
+	defer stack.intr.mutex.Unlock()
+
+	stack.intr.irqs = slices.DeleteFunc(stack.intr.irqs, func(entry IRQEntry) bool {
+		// NOTE: デバイスを包むデバイス（ImpairDevice）を指定した場合も削除できるように、デバイス情報で比較する
+		if entry.dev.Info() == dev.Info() {
+			logIntr.Debugf("unregisterd: irq=%d, dev=%s", entry.irq, entry.dev.Info().Name)
+			return true
+		}
+		return false
+	})
+
+	// ハンドラが無くなったIRQ線を削除する
+	for irq := range stack.intr.irqLines {
+		if !slices.ContainsFunc(stack.intr.irqs, func(entry IRQEntry) bool { return entry.irq == irq }) {
+			delete(stack.intr.irqLines, irq)
+		}
+	}
 	return true
 }
 
-func intrInit() bool {
-	signal.Stop(sigChan)
+// 割り込みを発生させる
+// NOTE: 任意のルーチンから呼び出してよい
+// 書籍では intr_raise_irq()
+func (stack *Stack) intrRaise(irq IntrIRQ) bool {
+	stack.intr.mutex.Lock()
+	line, ok := stack.intr.irqLines[irq]
+	if !ok {
+		stack.intr.mutex.Unlock()
+		logIntr.Errorf("not registered, irq=%d", irq)
+		return false
+	}
+	line.pending = true
+	disabled := line.disabled
+	stack.intr.mutex.Unlock()
+
+	if !disabled {
+		intrNotify(stack.intr.irqChan)
+	}
 	return true
 }
 
-func intrRun() bool {
-	go intrMain()
-	<-ready // シグナル受信ルーチンの準備完了を待機
+// 割り込みを許可する
+// NOTE: 禁止中に発生した割り込みは許可したときに処理される
+func (stack *Stack) intrEnable(irq IntrIRQ) bool {
+	stack.intr.mutex.Lock()
+	line, ok := stack.intr.irqLines[irq]
+	if !ok {
+		stack.intr.mutex.Unlock()
+		logIntr.Errorf("not registered, irq=%d", irq)
+		return false
+	}
+	line.disabled = false
+	pending := line.pending
+	stack.intr.mutex.Unlock()
+
+	if pending {
+		intrNotify(stack.intr.irqChan)
+	}
 	return true
 }
 
-func intrShutdown() bool {
-	close(terminate) // チャネルを閉じて終了指示
+// 割り込みを禁止する
+func (stack *Stack) intrDisable(irq IntrIRQ) bool {
+	stack.intr.mutex.Lock()
+	defer stack.intr.mutex.Unlock()
+
+	line, ok := stack.intr.irqLines[irq]
+	if !ok {
+		logIntr.Errorf("not registered, irq=%d", irq)
+		return false
+	}
+	line.disabled = true
 	return true
 }
 
-func intrMain() {
-	util.Debugf("start...")
+// 書籍では intr_raise_irq(INTR_IRQ_SOFTIRQ)
+func (stack *Stack) intrRaiseSoftIRQ() {
+	intrNotify(stack.intr.softirqChan)
+}
+
+// 書籍では intr_raise_irq(INTR_IRQ_EVENT)
+func (stack *Stack) intrRaiseEvent() {
+	intrNotify(stack.intr.eventChan)
+}
+
+func intrNotify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+		// 通知済みで未処理の場合は、まとめて処理されるため何もしない
+	}
+}
+
+// 未処理の割り込みのハンドラを取り出す
+func (stack *Stack) intrPendingEntries() []IRQEntry {
+	stack.intr.mutex.Lock()
+	defer stack.intr.mutex.Unlock()
+
+	var entries []IRQEntry
+	for _, entry := range stack.intr.irqs {
+		line := stack.intr.irqLines[entry.irq]
+		if line.pending && !line.disabled {
+			entries = append(entries, entry)
+		}
+	}
+	for _, line := range stack.intr.irqLines {
+		if !line.disabled {
+			line.pending = false
+		}
+	}
+	slices.SortStableFunc(entries, func(a, b IRQEntry) int {
+		return int(a.irq) - int(b.irq)
+	})
+	return entries
+}
+
+func (stack *Stack) intrInit() error {
+	// NOTE: シグナルを使用しないため初期化は不要
+	return nil
+}
+
+func (stack *Stack) intrRun() error {
+	if stack.intr.terminate != nil {
+		logIntr.Errorf("already running")
+		return fmt.Errorf("%w: already running", ErrInvalidState)
+	}
+
+	ready := make(chan struct{})
+	stack.intr.terminate = make(chan struct{})
+	stack.intr.done = make(chan struct{})
+	go stack.intrMain(ready, stack.intr.terminate, stack.intr.done)
+	<-ready // 割り込みルーチンの準備完了を待機
+
+	// 停止中に発生した割り込みを処理させる
+	intrNotify(stack.intr.irqChan)
+	intrNotify(stack.intr.softirqChan)
+	return nil
+}
+
+// NOTE: 割り込みルーチンの終了を待つため、再び intrRun() を呼び出すことができる
+func (stack *Stack) intrShutdown() error {
+	if stack.intr.terminate == nil {
+		logIntr.Errorf("not running")
+		return fmt.Errorf("%w: not running", ErrInvalidState)
+	}
+
+	close(stack.intr.terminate) // チャネルを閉じて終了指示
+	<-stack.intr.done
+	stack.intr.terminate = nil
+	stack.intr.done = nil
+	return nil
+}
+
+func (stack *Stack) intrMain(ready chan<- struct{}, terminate <-chan struct{}, done chan<- struct{}) {
+	logIntr.Debugf("start...")
+	defer close(done)
+
+	// NOTE: タイマーのハンドラも割り込みハンドラと同じルーチンで呼び出して処理を直列化する
+	ticker := time.NewTicker(intrTimerInterval)
+	defer ticker.Stop()
+
 	close(ready) // チャネルを閉じて準備完了を通知
 
 LOOP:
@@ -103,19 +298,26 @@ LOOP:
 		case <-terminate:
 			break LOOP
 
-		// シグナル受信
-		case sig := <-sigChan:
-			for _, entry := range irqs {
-				if entry.sig == sig {
-					util.Debugf("sig=%s, name=%s", entry.sig.String(), entry.dev.Info().Name)
-					entry.isr(entry.sig, entry.dev)
-					if (entry.flags ^ IntrIRQFlagShared) > 0 {
-						break
-					}
-				}
+		// 割り込み
+		// NOTE: 共有されたIRQの場合は、登録されたすべてのハンドラを呼び出す
+		case <-stack.intr.irqChan:
+			for _, entry := range stack.intrPendingEntries() {
+				logIntr.Debugf("irq=%d, name=%s", entry.irq, entry.dev.Info().Name)
+				entry.isr(entry.irq, entry.dev)
 			}
-			break
+
+		// ソフトウェア割り込み
+		case <-stack.intr.softirqChan:
+			stack.netSoftIRQHandler()
+
+		// イベント
+		case <-stack.intr.eventChan:
+			stack.netEventHandler()
+
+		// 周期タイマー
+		case <-ticker.C:
+			stack.netTimerHandler()
 		}
 	}
-	util.Debugf("terminated")
+	logIntr.Debugf("terminated")
 }
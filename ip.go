@@ -2,12 +2,16 @@ package microps
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math"
 	"math/rand/v2"
-	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/bugph0bia/go-microps/internal/util"
 )
@@ -53,7 +57,8 @@ const (
 // IP上位プロトコル
 type IPUpperProtocol interface { // 書籍では ip_protocol
 	Info() *IPUpperProtocolInfo
-	InputHandler(ipHdr *IPHdr, data []uint8, ipIface *IPIface)
+	// NOTE: data は上位プロトコルのデータ、packet は受信したデータグラム全体（IPヘッダを含む）
+	InputHandler(ipHdr *IPHdr, data []uint8, packet []uint8, ipIface *IPIface)
 }
 
 // ----------------------------------------------------------------------------
@@ -106,6 +111,37 @@ type IPHdr struct {
 	Dst      IPAddr // Destination Address
 }
 
+// NOTE: オプションは含まない
+func (hdr *IPHdr) Marshal(b []uint8) {
+	b[0] = hdr.VHL
+	b[1] = hdr.TOS
+	binary.NativeEndian.PutUint16(b[2:], hdr.Total)
+	binary.NativeEndian.PutUint16(b[4:], hdr.ID)
+	binary.NativeEndian.PutUint16(b[6:], hdr.Offset)
+	b[8] = hdr.TTL
+	b[9] = hdr.Protocol
+	binary.NativeEndian.PutUint16(b[10:], hdr.Sum)
+	binary.NativeEndian.PutUint32(b[12:], uint32(hdr.Src))
+	binary.NativeEndian.PutUint32(b[16:], uint32(hdr.Dst))
+}
+
+func (hdr *IPHdr) Unmarshal(b []uint8) bool {
+	if len(b) < IPHdrSizeMin {
+		return false
+	}
+	hdr.VHL = b[0]
+	hdr.TOS = b[1]
+	hdr.Total = binary.NativeEndian.Uint16(b[2:])
+	hdr.ID = binary.NativeEndian.Uint16(b[4:])
+	hdr.Offset = binary.NativeEndian.Uint16(b[6:])
+	hdr.TTL = b[8]
+	hdr.Protocol = b[9]
+	hdr.Sum = binary.NativeEndian.Uint16(b[10:])
+	hdr.Src = IPAddr(binary.NativeEndian.Uint32(b[12:]))
+	hdr.Dst = IPAddr(binary.NativeEndian.Uint32(b[16:]))
+	return true
+}
+
 // IPインタフェース
 type IPIface struct {
 	NetIfaceInfo
@@ -118,20 +154,40 @@ func (iface *IPIface) Info() *NetIfaceInfo {
 	return &iface.NetIfaceInfo
 }
 
+// NOTE: アドレス解決中の場合は、書籍と同様にパケットを破棄して ErrARPIncomplete を返す
 // 書籍では ip_output_device()
-func (iface *IPIface) Output(data []uint8, target IPAddr) bool {
-	util.Debugf("dev=%s, len=%d, target=%s", iface.Info().Dev.Info().Name, len(data), target.String())
+func (iface *IPIface) Output(data []uint8, target IPAddr) error {
+	logIP.Debugf("dev=%s, len=%d, target=%s", iface.Info().Dev.Info().Name, len(data), target.String())
+
+	stack := iface.Info().Dev.Info().stack
 
 	var hwaddr [netDeviceAddrLen]uint8
 	if iface.Info().Dev.Info().Flags&NetDeviceFlagNeedARP > 0 {
 		if (target == iface.broadcast) || (target == IPAddrBroadcast) {
 			hwaddr = iface.Dev.Info().Broadcast
 		} else {
-			util.Errorf("ARP does not implement")
-			return false
+			ha, err := stack.ARPResolve(iface, target)
+			switch {
+			case err == nil:
+				copy(hwaddr[:], ha[:])
+			case errors.Is(err, ErrARPIncomplete):
+				logIP.Debugf("arp incomplete, target=%s", target.String())
+				return err
+			default:
+				logIP.Errorf("ARPResolve() failure, target=%s", target.String())
+				return err
+			}
 		}
 	}
-	return NetDeviceOutput(iface.Info().Dev, NetProtocolTypeIP, data, hwaddr)
+	return stack.NetDeviceOutput(iface.Info().Dev, NetProtocolTypeIP, data, hwaddr)
+}
+
+// IP経路
+type IPRoute struct {
+	network IPAddr
+	netmask IPAddr
+	nexthop IPAddr // IPAddrAny の場合は直接接続されたネットワーク
+	iface   *IPIface
 }
 
 // IPプロトコル
@@ -145,46 +201,49 @@ func (proto *IPProtocol) Info() *NetProtocolInfo {
 
 // 書籍では ip_input()
 func (proto *IPProtocol) InputHandler(data []uint8, dev NetDevice) {
-	util.Debugf("dev=%s, len=%d", dev.Info().Name, len(data))
+	logIP.Debugf("dev=%s, len=%d", dev.Info().Name, len(data))
 
 	// data を IPHdr に変換
 	var hdr IPHdr
-	if !util.FromBytes(data, &hdr) {
-		util.Errorf("FromBytes() failure")
+	if !hdr.Unmarshal(data) {
+		logIP.Errorf("Unmarshal() failure")
 		return
 	}
 
 	var v uint8 = hdr.VHL >> 4
 	if v != IPVersionIPV4 {
-		util.Errorf("ip version error: v=%d", v)
+		logIP.Errorf("ip version error: v=%d", v)
 		return
 	}
 
 	var hlen uint8 = (hdr.VHL & 0x0f) << 2
+	if hlen < IPHdrSizeMin {
+		logIP.Errorf("header length error: hlen=%d", hlen)
+		return
+	}
 	if len(data) < int(hlen) {
-		util.Errorf("header length error: len=%d < hlen=%d", len(data), hlen)
+		logIP.Errorf("header length error: len=%d < hlen=%d", len(data), hlen)
 		return
 	}
 
-	c, ok := util.Cksum16(hdr, int(hlen), 0)
-	if !ok || c != 0 {
-		util.Errorf("checksum error")
+	if util.Cksum16(data[:hlen], 0) != 0 {
+		logIP.Errorf("checksum error")
 		return
 	}
 
 	total := util.Ntoh16(hdr.Total)
 	if len(data) < int(total) {
-		util.Errorf("total length error: len=%d < total=%d", len(data), total)
+		logIP.Errorf("total length error: len=%d < total=%d", len(data), total)
 		return
 	}
-
-	offset := util.Ntoh16(hdr.Offset)
-	if offset&IPHdrFlagMF > 0 || offset&IPHdrOffsetMask > 0 {
-		util.Errorf("fragments does not support")
+	if total < uint16(hlen) {
+		logIP.Errorf("total length error: total=%d < hlen=%d", total, hlen)
 		return
 	}
 
-	i := NetDeviceGetIface(dev, NetIfaceFamilyIP)
+	stack := proto.stack
+
+	i := stack.NetDeviceGetIface(dev, NetIfaceFamilyIP)
 	iface, ok := i.(*IPIface)
 	if !ok {
 		// 取得失敗したら何もしない
@@ -193,43 +252,75 @@ func (proto *IPProtocol) InputHandler(data []uint8, dev NetDevice) {
 
 	if hdr.Dst != iface.unicast {
 		if hdr.Dst != iface.broadcast && hdr.Dst != IPAddrBroadcast {
-			// 別のホストへの通信のため無視
-			return
+			if !stack.ip.forwarding.Load() {
+				// 別のホストへの通信のため無視
+				return
+			}
+
+			// ルーターとして動作する場合、自身の別のインタフェース宛てであれば受信する
+			local := stack.IPIfaceSelect(hdr.Dst)
+			if local == nil {
+				stack.ipForward(&hdr, data[:total], iface)
+				return
+			}
+			iface = local
 		}
 	}
 
-	util.Debugf("permit, dev=%s, iface=%s", dev.Info().Name, iface.unicast.String())
-	IPPrint(data[:total])
-
-	for _, upperProtocol := range upperProtocols {
-		if upperProtocol.Info().Protocol == IPUpperProtocolType(hdr.Protocol) {
-			upperProtocol.InputHandler(&hdr, data[hlen:], iface)
+	offset := util.Ntoh16(hdr.Offset)
+	if offset&IPHdrFlagMF > 0 || offset&IPHdrOffsetMask > 0 {
+		// フラグメントの場合は、すべて揃うまで上位プロトコルに渡さない
+		packet, ok := stack.ipReassInput(&hdr, data[:total])
+		if !ok {
 			return
 		}
+		// NOTE: ヘッダは先頭フラグメントのもの（オプションを含む）に置き換わるため、ヘッダ長も取り直す
+		data = packet
+		total = uint16(len(packet))
+		hdr.Unmarshal(packet)
+		hlen = (hdr.VHL & 0x0f) << 2
+	}
+
+	logIP.Debugf("permit, dev=%s, iface=%s", dev.Info().Name, iface.unicast.String())
+	ipPrint(data[:total], stack.dumpProtocol(NetProtocolTypeIP))
+
+	if upperProtocol := stack.ipUpperProtocolSelect(IPUpperProtocolType(hdr.Protocol)); upperProtocol != nil {
+		upperProtocol.InputHandler(&hdr, data[hlen:total], data[:total], iface)
+		return
 	}
 
 	// サポート外のプロトコル
 	if int(hlen+8) <= int(total) {
 		// ICMPメッセージの応答として送信されるべきではない
 		// ただし、ICMPは登録済みでここに到達することはない
-		ICMPOutput(ICMPTypeDestUnreach, ICMPCodeProtoUnreach, 0, data[:hlen+8], iface.unicast, hdr.Src)
+		stack.ICMPOutput(ICMPTypeDestUnreach, ICMPCodeProtoUnreach, 0, data[:hlen+8], iface.unicast, hdr.Src)
 	}
 }
 
 // IP上位プロトコル情報
 type IPUpperProtocolInfo struct {
 	Protocol IPUpperProtocolType
+	stack    *Stack // 登録先のプロトコルスタック
 }
 
-// NOTE: NetRun() を呼び出した後にエントリを追加/削除する場合はデバイスリストをロックすること
-var ifaces []*IPIface
-var upperProtocols []IPUpperProtocol
+// IPの状態
+type ipState struct {
+	// NOTE: 以降の変数は mutex をロックして参照すること
+	// NOTE: ip.mutex と net.mutex の両方をロックする場合は ip.mutex を先にロックすること
+	ifaces         []*IPIface
+	upperProtocols []IPUpperProtocol
+	routes         []*IPRoute
+	mutex          sync.RWMutex
+
+	// IPフォワーディング（ルーターとして動作する）の有効/無効
+	forwarding atomic.Bool
+}
 
 // ----------------------------------------------------------------------------
 // メインロジック
 // ----------------------------------------------------------------------------
 
-func IPIfaceAlloc(unicast string, netmask string) *IPIface {
+func IPIfaceAlloc(unicast string, netmask string) (*IPIface, error) {
 	var iface IPIface
 	iface.Info().Family = NetIfaceFamilyIP
 
@@ -237,37 +328,77 @@ func IPIfaceAlloc(unicast string, netmask string) *IPIface {
 
 	iface.unicast, ok = ParseIPAddr(unicast)
 	if !ok {
-		util.Errorf("ParseIPAddr() failure, addr=%s", unicast)
-		return nil
+		logIP.Errorf("ParseIPAddr() failure, addr=%s", unicast)
+		return nil, fmt.Errorf("%w, addr=%s", ErrInvalidAddr, unicast)
 	}
 
 	iface.netmask, ok = ParseIPAddr(netmask)
 	if !ok {
-		util.Errorf("ParseIPAddr() failure, addr=%s", netmask)
-		return nil
+		logIP.Errorf("ParseIPAddr() failure, addr=%s", netmask)
+		return nil, fmt.Errorf("%w, addr=%s", ErrInvalidAddr, netmask)
 	}
 
 	iface.broadcast = (iface.unicast & iface.netmask) | ^iface.netmask
 
-	return &iface
+	return &iface, nil
 }
 
-// NOTE: NetRun() より前に呼び出すこと
-func IPIfaceRegister(dev NetDevice, iface *IPIface) bool {
-	util.Infof("dev=%s, %s, %s, %s", dev.Info().Name,
+func (stack *Stack) IPIfaceRegister(dev NetDevice, iface *IPIface) error {
+	logIP.Infof("dev=%s, %s, %s, %s", dev.Info().Name,
 		iface.unicast.String(), iface.netmask.String(), iface.broadcast.String())
 
-	if !NetDeviceAddIface(dev, iface) {
-		util.Errorf("NetDeviceAddIntrerface() failure")
-		return false
+	stack.ip.mutex.Lock()
+	defer stack.ip.mutex.Unlock()
+
+	if err := stack.NetDeviceAddIface(dev, iface); err != nil {
+		logIP.Errorf("NetDeviceAddIntrerface() failure")
+		return err
 	}
-	ifaces = append(ifaces, iface)
 
-	return true
+	// 接続されたネットワークへの経路を登録する
+	stack.ipRouteAdd(iface.unicast&iface.netmask, iface.netmask, IPAddrAny, iface)
+
+	stack.ip.ifaces = append(stack.ip.ifaces, iface)
+
+	return nil
+}
+
+// インタフェースと、インタフェースを使用する経路を削除する（書籍には無い機能）
+func (stack *Stack) IPIfaceUnregister(iface *IPIface) error {
+	stack.ip.mutex.Lock()
+	defer stack.ip.mutex.Unlock()
+
+	idx := slices.Index(stack.ip.ifaces, iface)
+	if idx < 0 {
+		logIP.Errorf("not registered, iface=%s", iface.unicast.String())
+		return fmt.Errorf("%w, iface=%s", ErrNotFound, iface.unicast.String())
+	}
+
+	dev := iface.Info().Dev
+	if err := stack.NetDeviceDelIface(dev, iface); err != nil {
+		logIP.Errorf("NetDeviceDelIface() failure")
+		return err
+	}
+
+	stack.ip.ifaces = slices.Delete(stack.ip.ifaces, idx, idx+1)
+	stack.ip.routes = slices.DeleteFunc(stack.ip.routes, func(route *IPRoute) bool {
+		if route.iface == iface {
+			logIP.Infof("route deleted: network=%s, netmask=%s, nexthop=%s, iface=%s",
+				route.network.String(), route.netmask.String(), route.nexthop.String(), iface.unicast.String())
+			return true
+		}
+		return false
+	})
+
+	logIP.Infof("success, dev=%s, iface=%s", dev.Info().Name, iface.unicast.String())
+	return nil
 }
 
-func IPIfaceSelect(addr IPAddr) *IPIface {
-	for _, entry := range ifaces {
+func (stack *Stack) IPIfaceSelect(addr IPAddr) *IPIface {
+	stack.ip.mutex.RLock()
+	defer stack.ip.mutex.RUnlock()
+
+	for _, entry := range stack.ip.ifaces {
 		if entry.unicast == addr {
 			return entry
 		}
@@ -275,26 +406,280 @@ func IPIfaceSelect(addr IPAddr) *IPIface {
 	return nil
 }
 
-// NOTE: NetRun() より前に呼び出すこと
-func IPUpperProtocolRegister(upperProtocol IPUpperProtocol) bool {
-	for _, entry := range upperProtocols {
+func (stack *Stack) IPRouteAdd(network IPAddr, netmask IPAddr, nexthop IPAddr, iface *IPIface) error {
+	stack.ip.mutex.Lock()
+	defer stack.ip.mutex.Unlock()
+
+	if !slices.Contains(stack.ip.ifaces, iface) {
+		logIP.Errorf("iface not registered, iface=%s", iface.unicast.String())
+		return fmt.Errorf("%w: iface not registered, iface=%s", ErrNotFound, iface.unicast.String())
+	}
+
+	stack.ipRouteAdd(network, netmask, nexthop, iface)
+	return nil
+}
+
+// NOTE: ip.mutex をロックした状態で呼び出すこと
+func (stack *Stack) ipRouteAdd(network IPAddr, netmask IPAddr, nexthop IPAddr, iface *IPIface) {
+	route := IPRoute{
+		network: network,
+		netmask: netmask,
+		nexthop: nexthop,
+		iface:   iface,
+	}
+	stack.ip.routes = append(stack.ip.routes, &route)
+
+	logIP.Infof("route added: network=%s, netmask=%s, nexthop=%s, iface=%s, dev=%s",
+		network.String(), netmask.String(), nexthop.String(), iface.unicast.String(), iface.Info().Dev.Info().Name)
+}
+
+func (stack *Stack) IPRouteSetDefaultGateway(iface *IPIface, gateway string) error {
+	gw, ok := ParseIPAddr(gateway)
+	if !ok {
+		logIP.Errorf("ParseIPAddr() failure, addr=%s", gateway)
+		return fmt.Errorf("%w, addr=%s", ErrInvalidAddr, gateway)
+	}
+
+	if err := stack.IPRouteAdd(IPAddrAny, IPAddrAny, gw, iface); err != nil {
+		logIP.Errorf("IPRouteAdd() failure")
+		return err
+	}
+
+	return nil
+}
+
+// 最長一致で経路を検索する
+func (stack *Stack) IPRouteLookup(dst IPAddr) *IPRoute {
+	stack.ip.mutex.RLock()
+	defer stack.ip.mutex.RUnlock()
+
+	var candidate *IPRoute
+	for _, route := range stack.ip.routes {
+		if (dst & route.netmask) == route.network {
+			// ネットマスクはネットワークバイトオーダーのため、ホストバイトオーダーに変換して比較する
+			if candidate == nil || util.Ntoh32(uint32(candidate.netmask)) < util.Ntoh32(uint32(route.netmask)) {
+				candidate = route
+			}
+		}
+	}
+	return candidate
+}
+
+func (stack *Stack) IPRouteGetIface(dst IPAddr) *IPIface {
+	route := stack.IPRouteLookup(dst)
+	if route == nil {
+		return nil
+	}
+	return route.iface
+}
+
+func (stack *Stack) IPUpperProtocolRegister(upperProtocol IPUpperProtocol) error {
+	stack.ip.mutex.Lock()
+	defer stack.ip.mutex.Unlock()
+
+	for _, entry := range stack.ip.upperProtocols {
 		if entry.Info().Protocol == upperProtocol.Info().Protocol {
-			util.Errorf("already exists, protocol=%d", upperProtocol.Info().Protocol)
+			logIP.Errorf("already exists, protocol=%d", upperProtocol.Info().Protocol)
+			return fmt.Errorf("%w, protocol=%d", ErrAlreadyExists, upperProtocol.Info().Protocol)
+		}
+	}
+
+	upperProtocol.Info().stack = stack
+	stack.ip.upperProtocols = append(stack.ip.upperProtocols, upperProtocol)
+
+	logIP.Infof("success, protocol=%d", upperProtocol.Info().Protocol)
+	return nil
+}
+
+func (stack *Stack) ipUpperProtocolSelect(protocol IPUpperProtocolType) IPUpperProtocol {
+	stack.ip.mutex.RLock()
+	defer stack.ip.mutex.RUnlock()
+
+	for _, entry := range stack.ip.upperProtocols {
+		if entry.Info().Protocol == protocol {
+			return entry
+		}
+	}
+	return nil
+}
+
+// ルーターとして動作させる場合は有効にする（書籍には無い機能）
+func (stack *Stack) IPSetForwarding(enable bool) {
+	stack.ip.forwarding.Store(enable)
+	logIP.Infof("forwarding=%t", enable)
+}
+
+// 受信したデータグラムに対するICMPエラーメッセージを送信する
+// NOTE: data は受信したデータグラム全体（IPヘッダを含む）を渡すこと
+func (stack *Stack) ipSendICMPError(typ ICMPType, code ICMPCode, val uint32, hdr *IPHdr, data []uint8) bool {
+	hlen := int(hdr.VHL&0x0f) << 2
+
+	if hdr.Dst == IPAddrBroadcast || hdr.Src == IPAddrAny || hdr.Src == IPAddrBroadcast {
+		// ブロードキャストや送信元が不明なデータグラムには送信しない
+		return false
+	}
+	if util.Ntoh16(hdr.Offset)&IPHdrOffsetMask > 0 {
+		// 先頭以外のフラグメントには送信しない
+		return false
+	}
+	if IPUpperProtocolType(hdr.Protocol) == IPUpperProtocolTypeICMP && hlen < len(data) {
+		if ICMPType(data[hlen]).IsError() {
+			// ICMPエラーメッセージに対するICMPエラーメッセージは送信しない
 			return false
 		}
 	}
 
-	upperProtocols = append(upperProtocols, upperProtocol)
+	// 元のデータグラムのIPヘッダとペイロードの先頭8バイトを含める
+	size := min(hlen+8, len(data))
+	return stack.ICMPOutput(typ, code, val, data[:size], IPAddrAny, hdr.Src) == nil
+}
 
-	util.Infof("success, protocol=%d", upperProtocol.Info().Protocol)
-	return true
+// 書籍には無い機能
+// NOTE: data は受信したデータグラム全体（IPヘッダを含む）を渡すこと
+func (stack *Stack) ipForward(hdr *IPHdr, data []uint8, iface *IPIface) {
+	logIP.Debugf("%s => %s, len=%d, dev=%s", hdr.Src.String(), hdr.Dst.String(), len(data), iface.Info().Dev.Info().Name)
+
+	if hdr.Dst == iface.broadcast || hdr.Src == IPAddrAny || hdr.Src == IPAddrBroadcast {
+		// ブロードキャストは転送しない
+		return
+	}
+
+	if hdr.TTL <= 1 {
+		logIP.Debugf("ttl exceeded, src=%s, dst=%s", hdr.Src.String(), hdr.Dst.String())
+		stack.ipSendICMPError(ICMPTypeTimeExceeded, ICMPCodeExceededTTL, 0, hdr, data)
+		return
+	}
+
+	route := stack.IPRouteLookup(hdr.Dst)
+	if route == nil {
+		logIP.Errorf("no route to host, dst=%s", hdr.Dst.String())
+		stack.ipSendICMPError(ICMPTypeDestUnreach, ICMPCodeNetUnreach, 0, hdr, data)
+		return
+	}
+	nexthop := hdr.Dst
+	if route.nexthop != IPAddrAny {
+		nexthop = route.nexthop
+	}
+
+	dev := route.iface.Info().Dev
+	if dev.Info().MTU < len(data) && util.Ntoh16(hdr.Offset)&IPHdrFlagDF > 0 {
+		// フラグメント化が禁止されているため、ネクストホップのMTUを通知する
+		logIP.Errorf("fragment needed and DF set, dev=%s, mtu=%d < %d", dev.Info().Name, dev.Info().MTU, len(data))
+		stack.ipSendICMPError(ICMPTypeDestUnreach, ICMPCodeFragmentNeeded, util.Hton32(uint32(dev.Info().MTU)), hdr, data)
+		return
+	}
+
+	// TTL を減算してチェックサムを差分で更新する
+	buf := make([]uint8, len(data))
+	copy(buf, data)
+	old := binary.NativeEndian.Uint16(buf[8:]) // TTL & Protocol
+	buf[8]--
+	sum := util.CksumUpdate16(binary.NativeEndian.Uint16(buf[10:]), old, binary.NativeEndian.Uint16(buf[8:]))
+	binary.NativeEndian.PutUint16(buf[10:], sum) // チェックサム値のバイトオーダー変換は行わない
+
+	logIP.Debugf("forward, %s => %s, dev=%s => %s, nexthop=%s", hdr.Src.String(), hdr.Dst.String(),
+		iface.Info().Dev.Info().Name, dev.Info().Name, nexthop.String())
+	ipPrint(buf, stack.dumpProtocol(NetProtocolTypeIP))
+
+	if err := ipOutputDevice(route.iface, buf, nexthop); err != nil {
+		logIP.Errorf("ipOutputDevice() failure")
+		return
+	}
+}
+
+// ヘッダチェックサムを再計算して格納する（オプションを含むヘッダ全体が対象）
+func ipHdrUpdateCksum(buf []uint8) {
+	hlen := int(buf[0]&0x0f) << 2
+	buf[10] = 0x00 // Header Checksum
+	buf[11] = 0x00
+	sum := util.Cksum16(buf[:hlen], 0)
+	binary.NativeEndian.PutUint16(buf[10:], sum) // チェックサム値のバイトオーダー変換は行わない
 }
 
+// データグラムをMTUに収まるフラグメントに分割する（書籍には無い機能）
+// NOTE: フラグメント化されたデータグラムを再分割する場合にも対応する
+func ipFragment(packet []uint8, mtu int) ([][]uint8, bool) {
+	hlen := int(packet[0]&0x0f) << 2
+	total := int(binary.BigEndian.Uint16(packet[2:4]))
+	offset := binary.BigEndian.Uint16(packet[6:8])
+	base := int(offset&IPHdrOffsetMask) << 3
+	more := offset & IPHdrFlagMF
+	payload := packet[hlen:total]
+
+	var frags [][]uint8
+	for pos := 0; pos < len(payload); {
+		// NOTE: 簡単のために、オプションは先頭のフラグメントにのみ含める
+		hdr := packet[:hlen]
+		if pos > 0 {
+			hdr = packet[:IPHdrSizeMin]
+		}
+
+		// フラグメントオフセットは8バイト単位のため、先頭から8の倍数で区切る
+		size := (mtu - len(hdr)) &^ 7
+		if size <= 0 {
+			logIP.Errorf("mtu too small, mtu=%d", mtu)
+			return nil, false
+		}
+		size = min(size, len(payload)-pos)
+
+		frag := make([]uint8, 0, len(hdr)+size)
+		frag = append(frag, hdr...)
+		frag = append(frag, payload[pos:pos+size]...)
+		frag[0] = uint8((IPVersionIPV4 << 4) | (len(hdr) >> 2))
+
+		flags := more
+		if pos+size < len(payload) {
+			flags = IPHdrFlagMF
+		}
+		binary.BigEndian.PutUint16(frag[2:], uint16(len(frag)))
+		binary.BigEndian.PutUint16(frag[6:], flags|uint16((base+pos)>>3))
+		ipHdrUpdateCksum(frag)
+
+		frags = append(frags, frag)
+		pos += size
+	}
+
+	return frags, true
+}
+
+// 必要に応じてフラグメント化してから出力する
+func ipOutputDevice(iface *IPIface, packet []uint8, nexthop IPAddr) error {
+	mtu := iface.Info().Dev.Info().MTU
+	if len(packet) <= mtu {
+		return iface.Output(packet, nexthop)
+	}
+
+	frags, ok := ipFragment(packet, mtu)
+	if !ok {
+		logIP.Errorf("ipFragment() failure")
+		return fmt.Errorf("%w: fragment failure, dev=%s, mtu=%d", ErrMTUExceeded, iface.Info().Dev.Info().Name, mtu)
+	}
+
+	logIP.Debugf("fragmented, dev=%s, mtu=%d, len=%d, frags=%d", iface.Info().Dev.Info().Name, mtu, len(packet), len(frags))
+	for _, frag := range frags {
+		ipPrint(frag, iface.Info().Dev.Info().Stack().dumpProtocol(NetProtocolTypeIP))
+		if err := iface.Output(frag, nexthop); err != nil {
+			logIP.Errorf("iface.Output() failure")
+			return err
+		}
+	}
+	return nil
+}
+
+// NOTE: 16進ダンプは全体のダンプ出力が有効な場合のみ出力する
 func IPPrint(data []uint8) {
+	ipPrint(data, util.DumpEnabled())
+}
+
+func ipPrint(data []uint8, hex bool) {
+	if !logIP.Enabled(slog.LevelDebug) && !hex {
+		return
+	}
+
 	// data を IPHdr に変換
 	var hdr IPHdr
-	if !util.FromBytes(data, &hdr) {
-		util.Errorf("FromBytes() failure")
+	if !hdr.Unmarshal(data) {
+		logIP.Errorf("Unmarshal() failure")
 		return
 	}
 
@@ -316,11 +701,10 @@ func IPPrint(data []uint8) {
 	fmt.Fprintf(&sb, "        src: %s\n", hdr.Src.String())
 	fmt.Fprintf(&sb, "        dst: %s\n", hdr.Dst.String())
 
-	util.DebugDump(data)
-	fmt.Fprintf(os.Stderr, sb.String())
+	logIP.Dump(sb.String(), data, hex)
 }
 
-func IPBuildPacket(protocol IPUpperProtocolType, data []uint8, id uint16, offset uint16, src IPAddr, dst IPAddr) ([]uint8, bool) {
+func IPBuildPacket(protocol IPUpperProtocolType, data []uint8, id uint16, offset uint16, src IPAddr, dst IPAddr) ([]uint8, error) {
 	var hlen uint16 = IPHdrSizeMin
 	var total uint16 = hlen + uint16(len(data))
 
@@ -336,69 +720,90 @@ func IPBuildPacket(protocol IPUpperProtocolType, data []uint8, id uint16, offset
 	hdr.Src = src
 	hdr.Dst = dst
 
-	hdr.Sum, _ = util.Cksum16(hdr, int(hlen), 0) // チェックサム値のバイトオーダー変換は行わない
-
-	buf, ok := util.ToBytes(hdr)
-	if !ok {
-		util.Errorf("ToBytes() failure")
-		return nil, false
-	}
-	buf = append(buf, data...)
+	buf := make([]uint8, int(total))
+	hdr.Marshal(buf)
+	hdr.Sum = util.Cksum16(buf[:hlen], 0)
+	binary.NativeEndian.PutUint16(buf[10:], hdr.Sum) // チェックサム値のバイトオーダー変換は行わない
+	copy(buf[hlen:], data)
 
-	IPPrint(buf)
-	return buf, true
+	return buf, nil
 }
 
-func IPOutput(protocol IPUpperProtocolType, data []uint8, src IPAddr, dst IPAddr) (int, bool) {
-	util.Debugf("%s => %s, protocol=%d, len=%d", src.String(), dst.String(), protocol, len(data))
+func (stack *Stack) IPOutput(protocol IPUpperProtocolType, data []uint8, src IPAddr, dst IPAddr) (int, error) {
+	logIP.Debugf("%s => %s, protocol=%d, len=%d", src.String(), dst.String(), protocol, len(data))
 
-	if src == IPAddrAny {
-		util.Errorf("ip routing does not implement")
-		return 0, false
+	if src == IPAddrAny && dst == IPAddrBroadcast {
+		logIP.Errorf("source address is required for broadcast addresses")
+		return 0, fmt.Errorf("%w: source address is required for broadcast, dst=%s", ErrInvalidAddr, dst.String())
 	}
 
-	iface := IPIfaceSelect(src)
-	if iface == nil {
-		util.Errorf("iface not found, src=%s", src.String())
-		return 0, false
-	}
+	var iface *IPIface
+	var nexthop IPAddr
+	if dst == IPAddrBroadcast {
+		// リミテッドブロードキャストは経路によらず送信元アドレスのインタフェースから送信する
+		iface = stack.IPIfaceSelect(src)
+		if iface == nil {
+			logIP.Errorf("iface not found, src=%s", src.String())
+			return 0, fmt.Errorf("%w: iface not found, src=%s", ErrInvalidAddr, src.String())
+		}
+		nexthop = dst
+	} else {
+		route := stack.IPRouteLookup(dst)
+		if route == nil {
+			logIP.Errorf("no route to host, dst=%s", dst.String())
+			return 0, fmt.Errorf("%w, dst=%s", ErrNoRoute, dst.String())
+		}
 
-	if ((dst & iface.netmask) != (iface.unicast & iface.netmask)) && (dst != IPAddrBroadcast) {
-		util.Errorf("not reached, dst=%s", dst.String())
-		return 0, false
+		iface = route.iface
+		if src != IPAddrAny && src != iface.unicast {
+			logIP.Errorf("unable to output with specified source address, src=%s", src.String())
+			return 0, fmt.Errorf("%w: unable to output with specified source address, src=%s", ErrInvalidAddr, src.String())
+		}
+
+		nexthop = dst
+		if route.nexthop != IPAddrAny {
+			nexthop = route.nexthop
+		}
 	}
 
-	if iface.Info().Dev.Info().MTU < IPHdrSizeMin+len(data) {
-		util.Errorf("too long, dev=%s, mtu=%d < %d", iface.Info().Dev.Info().Name, iface.Info().Dev.Info().MTU, (IPHdrSizeMin + len(data)))
-		return 0, false
+	if IPPayloadSizeMax < len(data) {
+		logIP.Errorf("too long, len=%d, max=%d", len(data), IPPayloadSizeMax)
+		return 0, fmt.Errorf("%w, len=%d, max=%d", ErrTooLong, len(data), IPPayloadSizeMax)
 	}
 
 	id := rand.N[uint16](math.MaxUint16)
-	buf, ok := IPBuildPacket(protocol, data, id, 0, iface.unicast, dst)
-	if !ok {
-		util.Errorf("IPBuildPacket() failure")
-		return 0, false
+	buf, err := IPBuildPacket(protocol, data, id, 0, iface.unicast, dst)
+	if err != nil {
+		logIP.Errorf("IPBuildPacket() failure")
+		return 0, err
 	}
+	ipPrint(buf, stack.dumpProtocol(NetProtocolTypeIP))
 
-	if !iface.Output(buf, dst) {
-		util.Errorf("iface.Output() failure")
-		return 0, false
+	// MTU を超える場合はフラグメント化する
+	if err := ipOutputDevice(iface, buf, nexthop); err != nil {
+		logIP.Errorf("ipOutputDevice() failure")
+		return 0, err
 	}
 
-	return len(buf), true
+	return len(buf), nil
 }
 
-func IPInit() bool {
+func (stack *Stack) IPInit() error {
 	proto := IPProtocol{
 		NetProtocolInfo{
 			Typ: NetProtocolTypeIP,
 		},
 	}
 
-	if !NetProtocolRegister(&proto) {
-		util.Errorf("NetProtocolRegister() failure")
-		return false
+	if err := stack.NetProtocolRegister(&proto); err != nil {
+		logIP.Errorf("NetProtocolRegister() failure")
+		return err
 	}
 
-	return true
+	if err := stack.NetTimerRegister("IP Reassembly Timer", IPReassTimerInterval, stack.ipReassTimerHandler); err != nil {
+		logIP.Errorf("NetTimerRegister() failure")
+		return err
+	}
+
+	return nil
 }
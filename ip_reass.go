@@ -0,0 +1,302 @@
+package microps
+
+import (
+	"encoding/binary"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+const IPReassTimeout = 30 * time.Second
+
+const IPReassTimerInterval = 1 * time.Second
+
+// 同時に再構築するデータグラムの最大数
+const IPReassEntriesMax = 64
+
+// 再構築中のフラグメントが保持できる合計サイズの上限
+const IPReassMemoryMax = 256 * 1024
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// 再構築するデータグラムの識別子
+type ipReassKey struct {
+	src      IPAddr
+	dst      IPAddr
+	protocol uint8
+	id       uint16
+}
+
+// 受信済みのフラグメント
+type ipReassFragment struct {
+	offset int // ペイロード先頭からのオフセット（バイト単位）
+	data   []uint8
+}
+
+// 再構築中のデータグラム
+type ipReassEntry struct {
+	key       ipReassKey
+	hdr       []uint8 // 先頭フラグメントのヘッダ（オプションを含む）
+	frags     []ipReassFragment
+	total     int // ペイロードの全長（最後のフラグメントを受信するまでは -1）
+	size      int // 受信済みのペイロードのサイズ
+	timestamp time.Time
+}
+
+// 期限切れのエントリ
+// NOTE: ICMPメッセージはロックを解放してから送信するため、必要な情報のみを取り出して返す
+type ipReassExpired struct {
+	hdr  IPHdr
+	data []uint8 // 先頭フラグメントのIPヘッダとペイロード
+}
+
+// IPフラグメント再構築の状態
+type ipReassState struct {
+	entries map[ipReassKey]*ipReassEntry
+	memory  int // 保持しているペイロードの合計サイズ
+	mutex   sync.Mutex
+}
+
+func (reass *ipReassState) init() {
+	reass.entries = make(map[ipReassKey]*ipReassEntry)
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// NOTE: 以降の ipReassXxx() は reass.mutex をロックした状態で呼び出すこと
+
+func (stack *Stack) ipReassDelete(entry *ipReassEntry) {
+	logIP.Debugf("DELETE: src=%s, dst=%s, protocol=%d, id=%d",
+		entry.key.src.String(), entry.key.dst.String(), entry.key.protocol, entry.key.id)
+
+	stack.reass.memory -= entry.size
+	delete(stack.reass.entries, entry.key)
+}
+
+// 最も古いエントリを削除する
+func (stack *Stack) ipReassDeleteOldest(except *ipReassEntry) bool {
+	var oldest *ipReassEntry
+	for _, entry := range stack.reass.entries {
+		if entry == except {
+			continue
+		}
+		if oldest == nil || oldest.timestamp.After(entry.timestamp) {
+			oldest = entry
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+
+	stack.ipReassDelete(oldest)
+	return true
+}
+
+// 書籍には無い機能
+func (stack *Stack) ipReassExpire(now time.Time) []ipReassExpired {
+	var expired []ipReassExpired
+	for _, entry := range stack.reass.entries {
+		if now.Sub(entry.timestamp) <= IPReassTimeout {
+			continue
+		}
+
+		// 先頭のフラグメントを受信している場合のみ ICMP Time Exceeded を送信する
+		if entry.hdr != nil && len(entry.frags) > 0 && entry.frags[0].offset == 0 {
+			var hdr IPHdr
+			if hdr.Unmarshal(entry.hdr) {
+				data := append(slices.Clone(entry.hdr), entry.frags[0].data...)
+				expired = append(expired, ipReassExpired{hdr: hdr, data: data})
+			}
+		}
+		stack.ipReassDelete(entry)
+	}
+	return expired
+}
+
+// 書籍では ip_reass_timer_handler()（書籍には無い機能）
+func (stack *Stack) ipReassTimerHandler() {
+	stack.reass.mutex.Lock()
+	expired := stack.ipReassExpire(time.Now())
+	stack.reass.mutex.Unlock()
+
+	for _, e := range expired {
+		stack.ipSendICMPError(ICMPTypeTimeExceeded, ICMPCodeExceededFragment, 0, &e.hdr, e.data)
+	}
+}
+
+// フラグメントのうち受信済みの範囲と重複しない部分を追加して、追加したサイズを返す
+func (entry *ipReassEntry) insert(offset int, data []uint8) int {
+	end := offset + len(data)
+	cur := offset
+
+	var pieces []ipReassFragment
+	for _, frag := range entry.frags {
+		fragEnd := frag.offset + len(frag.data)
+		if fragEnd <= cur {
+			continue
+		}
+		if end <= frag.offset {
+			break
+		}
+		if cur < frag.offset {
+			pieces = append(pieces, ipReassFragment{offset: cur, data: data[cur-offset : frag.offset-offset]})
+		}
+		cur = max(cur, fragEnd)
+		if end <= cur {
+			break
+		}
+	}
+	if cur < end {
+		pieces = append(pieces, ipReassFragment{offset: cur, data: data[cur-offset:]})
+	}
+
+	added := 0
+	for _, piece := range pieces {
+		// 受信バッファを再利用されても問題無いようにコピーして保持する
+		piece.data = slices.Clone(piece.data)
+		entry.frags = append(entry.frags, piece)
+		entry.size += len(piece.data)
+		added += len(piece.data)
+	}
+	slices.SortFunc(entry.frags, func(a, b ipReassFragment) int {
+		return a.offset - b.offset
+	})
+	return added
+}
+
+// 受信済みのフラグメントの末尾のオフセット
+func (entry *ipReassEntry) end() int {
+	if len(entry.frags) == 0 {
+		return 0
+	}
+	last := entry.frags[len(entry.frags)-1]
+	return last.offset + len(last.data)
+}
+
+// すべてのフラグメントが揃っていればデータグラムを再構築する
+func (entry *ipReassEntry) complete() ([]uint8, bool) {
+	if entry.hdr == nil || entry.total < 0 || entry.size != entry.total {
+		return nil, false
+	}
+
+	// 重複を除いて保持しているため、サイズが一致すれば欠けは無い
+	packet := slices.Clone(entry.hdr)
+	for _, frag := range entry.frags {
+		packet = append(packet, frag.data...)
+	}
+
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet))) // Total Length
+	binary.BigEndian.PutUint16(packet[6:], 0)                   // Flags & Fragment Offset
+	ipHdrUpdateCksum(packet)
+
+	return packet, true
+}
+
+// 書籍には無い機能
+// NOTE: data は受信したフラグメント全体（IPヘッダを含む）を渡すこと
+func (stack *Stack) ipReassInput(hdr *IPHdr, data []uint8) ([]uint8, bool) {
+	hlen := int(hdr.VHL&0x0f) << 2
+	offset := util.Ntoh16(hdr.Offset)
+	more := offset&IPHdrFlagMF > 0
+	pos := int(offset&IPHdrOffsetMask) << 3
+	payload := data[hlen:]
+
+	if more && len(payload)%8 != 0 {
+		logIP.Errorf("invalid fragment length, len=%d", len(payload))
+		return nil, false
+	}
+
+	stack.reass.mutex.Lock()
+	defer stack.reass.mutex.Unlock()
+
+	return stack.ipReassUpdate(hdr, data[:hlen], pos, payload, more)
+}
+
+func (stack *Stack) ipReassUpdate(hdr *IPHdr, hdrBytes []uint8, pos int, payload []uint8, more bool) ([]uint8, bool) {
+	key := ipReassKey{
+		src:      hdr.Src,
+		dst:      hdr.Dst,
+		protocol: hdr.Protocol,
+		id:       util.Ntoh16(hdr.ID),
+	}
+
+	entry, ok := stack.reass.entries[key]
+	if !ok {
+		if IPReassEntriesMax <= len(stack.reass.entries) {
+			stack.ipReassDeleteOldest(nil)
+		}
+		entry = &ipReassEntry{
+			key:       key,
+			total:     -1,
+			timestamp: time.Now(),
+		}
+		stack.reass.entries[key] = entry
+		logIP.Debugf("INSERT: src=%s, dst=%s, protocol=%d, id=%d", key.src.String(), key.dst.String(), key.protocol, key.id)
+	}
+
+	// 再構築したデータグラムが最大長を超える場合はエントリごと破棄する
+	// NOTE: ヘッダ長は先頭フラグメントのものを使う（未受信の場合は受信したフラグメントのもの）
+	hlen := len(hdrBytes)
+	if entry.hdr != nil {
+		hlen = len(entry.hdr)
+	}
+	end := pos + len(payload)
+	if IPTotalSizeMax-hlen < max(end, entry.total, entry.end()) {
+		logIP.Errorf("too long, offset=%d, len=%d, hlen=%d", pos, len(payload), hlen)
+		stack.ipReassDelete(entry)
+		return nil, false
+	}
+
+	if !more {
+		if 0 <= entry.total && entry.total != end {
+			logIP.Errorf("inconsistent last fragment, total=%d, end=%d", entry.total, end)
+			stack.ipReassDelete(entry)
+			return nil, false
+		}
+		if end < entry.end() {
+			logIP.Errorf("fragment exceeds last fragment, end=%d", end)
+			stack.ipReassDelete(entry)
+			return nil, false
+		}
+		entry.total = end
+	} else if 0 <= entry.total && entry.total < end {
+		logIP.Errorf("fragment exceeds total length, total=%d, end=%d", entry.total, end)
+		stack.ipReassDelete(entry)
+		return nil, false
+	}
+
+	if pos == 0 && entry.hdr == nil {
+		entry.hdr = slices.Clone(hdrBytes)
+	}
+
+	// 全体のメモリ使用量の上限を超える場合は古いエントリから削除する
+	for IPReassMemoryMax < stack.reass.memory+len(payload) {
+		if !stack.ipReassDeleteOldest(entry) {
+			logIP.Errorf("memory limit exceeded, memory=%d, len=%d", stack.reass.memory, len(payload))
+			stack.ipReassDelete(entry)
+			return nil, false
+		}
+	}
+
+	stack.reass.memory += entry.insert(pos, payload)
+	logIP.Debugf("UPDATE: id=%d, offset=%d, len=%d, size=%d, total=%d", key.id, pos, len(payload), entry.size, entry.total)
+
+	packet, ok := entry.complete()
+	if !ok {
+		return nil, false
+	}
+
+	stack.ipReassDelete(entry)
+	logIP.Debugf("reassembled, id=%d, len=%d", key.id, len(packet))
+	return packet, true
+}
@@ -0,0 +1,169 @@
+package microps
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+// ヘッダの変換のベンチマーク（書籍には無い機能）
+// NOTE: 比較のため、以前の reflection を使う encoding/binary による変換（ToBytes() / FromBytes()）も計測する
+
+// 以前の実装
+func toBytes(v any) ([]uint8, bool) {
+	buffer := new(bytes.Buffer)
+	if err := binary.Write(buffer, binary.NativeEndian, v); err != nil {
+		return nil, false
+	}
+	return buffer.Bytes(), true
+}
+
+func fromBytes(data []uint8, v any) bool {
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.NativeEndian, v); err != nil {
+		return false
+	}
+	return true
+}
+
+var benchIPHdr = IPHdr{
+	VHL:      0x45,
+	Total:    util.Hton16(1500),
+	ID:       util.Hton16(1),
+	TTL:      0xff,
+	Protocol: uint8(IPUpperProtocolTypeTCP),
+	Src:      0x0100007f,
+	Dst:      0x0100007f,
+}
+
+func BenchmarkIPHdrMarshal(b *testing.B) {
+	b.ReportAllocs()
+	buf := make([]uint8, IPHdrSizeMin)
+	for b.Loop() {
+		benchIPHdr.Marshal(buf)
+	}
+}
+
+func BenchmarkIPHdrMarshalBinary(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		toBytes(benchIPHdr)
+	}
+}
+
+func BenchmarkIPHdrUnmarshal(b *testing.B) {
+	b.ReportAllocs()
+	buf, _ := toBytes(benchIPHdr)
+	var hdr IPHdr
+	for b.Loop() {
+		hdr.Unmarshal(buf)
+	}
+}
+
+func BenchmarkIPHdrUnmarshalBinary(b *testing.B) {
+	b.ReportAllocs()
+	buf, _ := toBytes(benchIPHdr)
+	var hdr IPHdr
+	for b.Loop() {
+		fromBytes(buf, &hdr)
+	}
+}
+
+// ヘッダの変換のテスト（書籍には無い機能）
+// NOTE: 各ヘッダの既知のバイト列（ネットワーク上の表現）と相互に変換できることを確認する
+
+type testHdr interface {
+	Marshal(b []uint8)
+	Unmarshal(b []uint8) bool
+}
+
+// hdr を Marshal() したバイト列が wire と一致し、wire を Unmarshal() した got が hdr と一致することを確認する
+func testHdrRoundTrip(t *testing.T, hdr testHdr, got testHdr, wire []uint8) {
+	t.Helper()
+
+	buf := make([]uint8, len(wire))
+	hdr.Marshal(buf)
+	if !bytes.Equal(buf, wire) {
+		t.Errorf("Marshal() = % x, want % x", buf, wire)
+	}
+
+	if !got.Unmarshal(wire) {
+		t.Fatalf("Unmarshal() failure")
+	}
+	if !reflect.DeepEqual(got, hdr) {
+		t.Errorf("Unmarshal() = %+v, want %+v", got, hdr)
+	}
+
+	if got.Unmarshal(wire[:len(wire)-1]) {
+		t.Errorf("Unmarshal() of a short buffer succeeded")
+	}
+}
+
+func testParseIPAddr(t *testing.T, str string) IPAddr {
+	t.Helper()
+
+	addr, ok := ParseIPAddr(str)
+	if !ok {
+		t.Fatalf("ParseIPAddr() failure, str=%s", str)
+	}
+	return addr
+}
+
+func TestIPHdrMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  IPHdr
+		wire []uint8
+	}{
+		{
+			name: "UDP, DF",
+			hdr: IPHdr{
+				VHL:      0x45,
+				Total:    util.Hton16(0x0073),
+				Offset:   util.Hton16(0x4000),
+				TTL:      0x40,
+				Protocol: uint8(IPUpperProtocolTypeUDP),
+				Sum:      util.Hton16(0xb861),
+				Src:      testParseIPAddr(t, "192.168.0.1"),
+				Dst:      testParseIPAddr(t, "192.168.0.199"),
+			},
+			wire: []uint8{
+				0x45, 0x00, 0x00, 0x73,
+				0x00, 0x00, 0x40, 0x00,
+				0x40, 0x11, 0xb8, 0x61,
+				0xc0, 0xa8, 0x00, 0x01,
+				0xc0, 0xa8, 0x00, 0xc7,
+			},
+		},
+		{
+			name: "TCP, MF and offset",
+			hdr: IPHdr{
+				VHL:      0x45,
+				TOS:      0x10,
+				Total:    util.Hton16(1500),
+				ID:       util.Hton16(0x1234),
+				Offset:   util.Hton16(IPHdrFlagMF | 0x00b9),
+				TTL:      0xff,
+				Protocol: uint8(IPUpperProtocolTypeTCP),
+				Src:      testParseIPAddr(t, "127.0.0.1"),
+				Dst:      testParseIPAddr(t, "10.0.0.2"),
+			},
+			wire: []uint8{
+				0x45, 0x10, 0x05, 0xdc,
+				0x12, 0x34, 0x20, 0xb9,
+				0xff, 0x06, 0x00, 0x00,
+				0x7f, 0x00, 0x00, 0x01,
+				0x0a, 0x00, 0x00, 0x02,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHdrRoundTrip(t, &tt.hdr, &IPHdr{}, tt.wire)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package microps
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+// ----------------------------------------------------------------------------
+// ロギング（書籍には無い機能）
+// ----------------------------------------------------------------------------
+
+// NOTE:
+// Logger はパッケージ変数のため、ハンドラとログレベルの設定はプロセス全体で共通となる（Stack ごとには持たない）
+// 同じプロセスで複数の Stack を動かすテストでは、設定を変更するテストを並行に実行しないこと
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+// ログのサブシステム名
+const (
+	LogSubsystemDefault = util.DefaultLoggerName
+	LogSubsystemNet     = "net"
+	LogSubsystemIntr    = "intr"
+	LogSubsystemEther   = "ether"
+	LogSubsystemIP      = "ip"
+	LogSubsystemARP     = "arp"
+	LogSubsystemICMP    = "icmp"
+	LogSubsystemUDP     = "udp"
+	LogSubsystemTCP     = "tcp"
+)
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+var (
+	logNet   = util.NewLogger(LogSubsystemNet)
+	logIntr  = util.NewLogger(LogSubsystemIntr)
+	logEther = util.NewLogger(LogSubsystemEther)
+	logIP    = util.NewLogger(LogSubsystemIP)
+	logARP   = util.NewLogger(LogSubsystemARP)
+	logICMP  = util.NewLogger(LogSubsystemICMP)
+	logUDP   = util.NewLogger(LogSubsystemUDP)
+	logTCP   = util.NewLogger(LogSubsystemTCP)
+)
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// ログの出力先のハンドラを設定する
+// NOTE: nil を指定した場合は既定のハンドラ（標準エラー出力へのテキスト形式）に戻す
+func SetLogHandler(handler slog.Handler) {
+	util.SetLogHandler(handler)
+}
+
+// 既定のハンドラと同じテキスト形式で w に出力するハンドラを生成する
+func NewLogTextHandler(w io.Writer) slog.Handler {
+	return util.NewTextHandler(w)
+}
+
+// 全体のログレベルを設定する（既定は slog.LevelDebug）
+func SetLogLevel(level slog.Level) {
+	util.SetLogLevel(level)
+}
+
+// サブシステムのログレベルを設定する
+func SetSubsystemLogLevel(name string, level slog.Level) error {
+	logger, ok := util.LookupLogger(name)
+	if !ok {
+		return fmt.Errorf("%w, subsystem=%s", ErrNotFound, name)
+	}
+	logger.SetLevel(level)
+	return nil
+}
+
+// サブシステムのログレベルの設定を解除して全体のログレベルに従うようにする
+func ResetSubsystemLogLevel(name string) error {
+	logger, ok := util.LookupLogger(name)
+	if !ok {
+		return fmt.Errorf("%w, subsystem=%s", ErrNotFound, name)
+	}
+	logger.ResetLevel()
+	return nil
+}
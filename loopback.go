@@ -2,8 +2,7 @@ package microps
 
 import (
 	"math"
-
-	"github.com/bugph0bia/go-microps/internal/util"
+	"sync"
 )
 
 const loopbackMTU = math.MaxUint16 // IPダイアグラムの最大値
@@ -12,9 +11,18 @@ const loopbackMTU = math.MaxUint16 // IPダイアグラムの最大値
 // データ
 // ----------------------------------------------------------------------------
 
+// 送信済みのデータ
+type loopbackQueueEntry struct {
+	typ  NetProtocolType
+	data []uint8
+}
+
 // ループバックデバイス
 type LoopbackDevice struct {
 	NetDeviceInfo
+	irq   IntrIRQ
+	mutex sync.Mutex
+	queue []loopbackQueueEntry
 }
 
 func (dev *LoopbackDevice) Info() *NetDeviceInfo {
@@ -31,30 +39,80 @@ func (dev *LoopbackDevice) Close() bool {
 	return true
 }
 
+// NOTE:
+// 書籍と同様に送信データをキューに格納してIRQを発生させ、受信処理は割り込みハンドラで行う
+// （送信元のロックを保持したまま受信処理が呼び出されてデッドロックすることを防ぐ）
+// 書籍では loopback_transmit()
 func (dev *LoopbackDevice) Output(typ NetProtocolType, data []uint8, dst any) bool {
-	util.Debugf("dv=%s, type=0x%04x, len=%d", dev.Name, typ, len(data))
-	util.DebugDump(data)
-	return NetInput(typ, data, dev)
+	dev.mutex.Lock()
+	// 呼び出し元がバッファを再利用しても問題無いようにコピーして保持する
+	dev.queue = append(dev.queue, loopbackQueueEntry{typ: typ, data: append([]uint8(nil), data...)})
+	num := len(dev.queue)
+	dev.mutex.Unlock()
+
+	logNet.Debugf("queue pushed (num:%d), dev=%s, type=0x%04x, len=%d", num, dev.Name, typ, len(data))
+	logNet.Dump("", data, dumpDevice(dev))
+	return dev.stack.intrRaise(dev.irq)
+}
+
+// 送信済みのデータを１つ取り出す
+func (dev *LoopbackDevice) dequeue() (loopbackQueueEntry, bool) {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	if len(dev.queue) == 0 {
+		return loopbackQueueEntry{}, false
+	}
+	entry := dev.queue[0]
+	dev.queue = dev.queue[1:]
+	return entry, true
 }
 
 // ----------------------------------------------------------------------------
 // メインロジック
 // ----------------------------------------------------------------------------
 
-func LoopbackInit() NetDevice {
+// 割り込みハンドラ
+// 書籍では loopback_isr()
+func loopbackISR(irq IntrIRQ, dev NetDevice) {
+	lo, ok := dev.(*LoopbackDevice)
+	if !ok {
+		logNet.Errorf("not loopback device, dev=%s", dev.Info().Name)
+		return
+	}
+
+	// IRQ はまとめて通知されることがあるため、キューが空になるまで処理する
+	for {
+		entry, ok := lo.dequeue()
+		if !ok {
+			break
+		}
+		logNet.Debugf("queue popped, dev=%s, type=0x%04x, len=%d", lo.Name, entry.typ, len(entry.data))
+		lo.stack.NetInput(entry.typ, entry.data, lo)
+	}
+}
+
+func (stack *Stack) LoopbackInit() (NetDevice, error) {
 	dev := LoopbackDevice{
-		NetDeviceInfo{
+		NetDeviceInfo: NetDeviceInfo{
 			Typ:   NetDeviceTypeLoopback,
 			MTU:   loopbackMTU,
 			Flags: NetDeviceFlagLoopback,
 			Hlen:  0, // non header
 			Alen:  0, // non address
 		},
+		irq: stack.intrIRQAlloc(),
+	}
+	if err := stack.NetDeviceRegister(&dev); err != nil {
+		logNet.Errorf("NetDeviceRegister() failure")
+		return nil, err
 	}
-	if !NetDeviceRegister(&dev) {
-		util.Errorf("NetDeviceRegister() failure")
-		return nil
+
+	if err := stack.intrRegister(dev.irq, loopbackISR, IntrIRQFlagShared, &dev); err != nil {
+		logNet.Errorf("intrRegister() failure, dev=%s", dev.Name)
+		return nil, err
 	}
-	util.Infof("success, dev=%s", dev.Info().Name)
-	return &dev
+
+	logNet.Infof("success, dev=%s", dev.Info().Name)
+	return &dev, nil
 }
@@ -2,8 +2,10 @@ package microps
 
 import (
 	"fmt"
-
-	"github.com/bugph0bia/go-microps/internal/util"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ----------------------------------------------------------------------------
@@ -23,7 +25,7 @@ const (
 type NetDeviceFlag uint16
 
 const (
-	NetDeviceFlagUp        NetDeviceFlag = 0x0001
+	NetDeviceFlagUp        NetDeviceFlag = 0x0001 // NOTE: Flags には格納しない（NetDeviceInfo.IsUp() で判定する）
 	NetDeviceFlagLoopback  NetDeviceFlag = 0x0010
 	NetDeviceFlagBroadcast NetDeviceFlag = 0x0020
 	NetDeviceFlagP2p       NetDeviceFlag = 0x0040
@@ -47,6 +49,9 @@ const (
 	NetProtocolTypeIPV6 NetProtocolType = 0x86dd
 )
 
+// プロトコルごとの受信キューの長さの上限（超えた場合は破棄する）
+const NetProtocolQueueSizeMax = 256
+
 // ----------------------------------------------------------------------------
 // インタフェース
 // ----------------------------------------------------------------------------
@@ -83,19 +88,33 @@ type NetDeviceInfo struct {
 	Name      string
 	Typ       NetDeviceType
 	MTU       int
-	Flags     NetDeviceFlag
+	Flags     NetDeviceFlag // NOTE: 登録した後は変更しない（動作中かどうかは IsUp() で判定する）
 	Hlen      int
 	Alen      int
 	Addr      [netDeviceAddrLen]uint8
 	Broadcast [netDeviceAddrLen]uint8
 	Priv      any
+	stack     *Stack                       // 登録先のプロトコルスタック
+	opened    atomic.Bool                  // 動作中（UP）か
+	dump      atomic.Bool                  // 16進ダンプ出力の有効/無効
+	impair    atomic.Pointer[ImpairDevice] // デバイスを包んで障害を与えるデバイス
+	capture   atomic.Pointer[netCapture]   // パケットキャプチャの状態
+}
+
+// デバイスを登録したプロトコルスタック（削除した後も保持する）
+// NOTE: デバイスのドライバは受信したデータをこのプロトコルスタックの NetInput() に渡すこと
+func (dev *NetDeviceInfo) Stack() *Stack {
+	return dev.stack
 }
 
-func (dev NetDeviceInfo) IsUp() bool {
-	return (dev.Flags & NetDeviceFlagUp) > 0x0000
+// NOTE:
+// NetDeviceOpen() / NetDeviceClose() で変化する UP の状態は、ロックせずに参照できるように Flags とは別に保持する
+// （Flags は能力を表す変化しないフラグのみとする）
+func (dev *NetDeviceInfo) IsUp() bool {
+	return dev.opened.Load()
 }
 
-func (dev NetDeviceInfo) State() string {
+func (dev *NetDeviceInfo) State() string {
 	if dev.IsUp() {
 		return "UP"
 	} else {
@@ -111,98 +130,243 @@ type NetIfaceInfo struct {
 
 // ネットプロトコル情報
 type NetProtocolInfo struct {
-	Typ NetProtocolType
+	Typ   NetProtocolType
+	stack *Stack // 登録先のプロトコルスタック
+	mutex sync.Mutex
+	queue []netProtocolQueueEntry // 受信キュー
+	drops uint64                  // キューが溢れて破棄したデータの数
+}
+
+// 受信キューが溢れて破棄したデータの数
+func (proto *NetProtocolInfo) Drops() uint64 {
+	proto.mutex.Lock()
+	defer proto.mutex.Unlock()
+
+	return proto.drops
+}
+
+// 受信キューのエントリ
+type netProtocolQueueEntry struct {
+	dev  NetDevice
+	data []uint8
+}
+
+// タイマーハンドラ型
+type NetTimerHandler func()
+
+// タイマー
+type netTimer struct {
+	name     string
+	interval time.Duration
+	last     time.Time // 最後にハンドラを呼び出した時刻
+	handler  NetTimerHandler
+}
+
+// イベントハンドラ型
+type NetEventHandler func(arg any)
+
+// イベントの購読者
+type netEvent struct {
+	handler NetEventHandler
+	arg     any
 }
 
-// NOTE: NetRun() を呼び出した後にエントリを追加/削除する場合はデバイスリストをロックすること
-var Devices []NetDevice
-var Protocols []NetProtocol
+// ネットスタックの状態
+// NOTE: デバイスのフラグ・インタフェースのリストも mutex をロックして参照すること
+type netState struct {
+	devices     []NetDevice
+	protocols   []NetProtocol
+	timers      []*netTimer
+	events      []netEvent
+	deviceIndex int // デバイス名の採番用
+	mutex       sync.RWMutex
+}
 
 // ----------------------------------------------------------------------------
 // メインロジック
 // ----------------------------------------------------------------------------
 
-// NOTE: NetRun() より前に呼び出すこと
-func NetDeviceRegister(dev NetDevice) bool {
-	dev.Info().Name = fmt.Sprintf("net%d", len(Devices))
-	Devices = append(Devices, dev)
+// 登録されているデバイスの一覧
+func (stack *Stack) Devices() []NetDevice {
+	stack.net.mutex.RLock()
+	defer stack.net.mutex.RUnlock()
+
+	return slices.Clone(stack.net.devices)
+}
+
+// NOTE: NetRun() の後に登録した場合は NetDeviceOpen() を呼び出すこと
+func (stack *Stack) NetDeviceRegister(dev NetDevice) error {
+	stack.net.mutex.Lock()
+	defer stack.net.mutex.Unlock()
+
+	if slices.Contains(stack.net.devices, dev) {
+		logNet.Errorf("already registered, dev=%s", dev.Info().Name)
+		return fmt.Errorf("%w, dev=%s", ErrAlreadyExists, dev.Info().Name)
+	}
+	if dev.Info().stack != nil && dev.Info().stack != stack {
+		// IRQ はプロトコルスタックごとに管理するため、別のプロトコルスタックには登録できない
+		logNet.Errorf("registered with another stack, dev=%s", dev.Info().Name)
+		return fmt.Errorf("%w: registered with another stack, dev=%s", ErrInvalidArgument, dev.Info().Name)
+	}
+
+	// NOTE: デバイスを削除しても名前が重複しないように、リストの長さではなく連番で採番する
+	dev.Info().Name = fmt.Sprintf("net%d", stack.net.deviceIndex)
+	dev.Info().stack = stack
+	stack.net.deviceIndex++
+	stack.net.devices = append(stack.net.devices, dev)
+
+	logNet.Infof("success, dev=%s, type=0x%04x", dev.Info().Name, dev.Info().Typ)
+	return nil
+}
+
+// デバイスを停止して、紐づくインタフェースと割り込みハンドラとともに削除する（書籍には無い機能）
+func (stack *Stack) NetDeviceUnregister(dev NetDevice) error {
+	logNet.Infof("dev=%s", dev.Info().Name)
+
+	stack.net.mutex.RLock()
+	registered := slices.Contains(stack.net.devices, dev)
+	up := dev.Info().IsUp()
+	netIfaces := slices.Clone(dev.Info().ifaces)
+	stack.net.mutex.RUnlock()
+
+	if !registered {
+		logNet.Errorf("not registered, dev=%s", dev.Info().Name)
+		return fmt.Errorf("%w, dev=%s", ErrNotFound, dev.Info().Name)
+	}
+
+	if up {
+		if err := stack.NetDeviceClose(dev); err != nil {
+			logNet.Errorf("NetDeviceClose() failure, dev=%s", dev.Info().Name)
+			return err
+		}
+	}
 
-	util.Infof("success, dev=%s, type=0x%04x", dev.Info().Name, dev.Info().Typ)
-	return true
+	for _, iface := range netIfaces {
+		if ipIface, ok := iface.(*IPIface); ok {
+			stack.IPIfaceUnregister(ipIface)
+		}
+	}
+
+	stack.intrUnregister(dev)
+	captureClose(dev)
+
+	stack.net.mutex.Lock()
+	stack.net.devices = slices.DeleteFunc(stack.net.devices, func(entry NetDevice) bool {
+		return entry == dev
+	})
+	stack.net.mutex.Unlock()
+
+	logNet.Infof("success, dev=%s", dev.Info().Name)
+	return nil
 }
 
-func NetDeviceOpen(dev NetDevice) bool {
-	util.Infof("dev=%s", dev.Info().Name)
+func (stack *Stack) NetDeviceOpen(dev NetDevice) error {
+	logNet.Infof("dev=%s", dev.Info().Name)
+
+	// NOTE: 同じデバイスの Open と Close が同時に実行されないように、ロックしたまま呼び出す
+	stack.net.mutex.Lock()
+	defer stack.net.mutex.Unlock()
 
 	if dev.Info().IsUp() {
-		util.Errorf("already opened, dev=%s", dev.Info().Name)
-		return false
+		logNet.Errorf("already opened, dev=%s", dev.Info().Name)
+		return fmt.Errorf("%w: already opened, dev=%s", ErrInvalidState, dev.Info().Name)
 	}
 
 	if !dev.Open() {
-		util.Errorf("failure, dev=%s", dev.Info().Name)
-		return false
+		logNet.Errorf("failure, dev=%s", dev.Info().Name)
+		return fmt.Errorf("%w: open failure, dev=%s", ErrDeviceIO, dev.Info().Name)
 	}
-	dev.Info().Flags |= NetDeviceFlagUp
+	dev.Info().opened.Store(true)
 
-	return true
+	return nil
 }
 
-func NetDeviceClose(dev NetDevice) bool {
-	util.Infof("dev=%s", dev.Info().Name)
+func (stack *Stack) NetDeviceClose(dev NetDevice) error {
+	logNet.Infof("dev=%s", dev.Info().Name)
+
+	stack.net.mutex.Lock()
+	defer stack.net.mutex.Unlock()
 
 	if !dev.Info().IsUp() {
-		util.Errorf("not opened, dev=%s", dev.Info().Name)
-		return false
+		logNet.Errorf("not opened, dev=%s", dev.Info().Name)
+		return fmt.Errorf("%w, dev=%s", ErrDeviceDown, dev.Info().Name)
 	}
 
 	if !dev.Close() {
-		util.Errorf("failure, dev=%s", dev.Info().Name)
-		return false
+		logNet.Errorf("failure, dev=%s", dev.Info().Name)
+		return fmt.Errorf("%w: close failure, dev=%s", ErrDeviceIO, dev.Info().Name)
 	}
-	dev.Info().Flags &^= NetDeviceFlagUp
+	dev.Info().opened.Store(false)
 
-	return true
+	return nil
 }
 
-func NetDeviceOutput(dev NetDevice, typ NetProtocolType, data []uint8, dst any) bool {
-	util.Debugf("dev=%s, type=0x%04x, %d", dev.Info().Name, typ, len(data))
-	util.DebugDump(data)
+func (stack *Stack) NetDeviceIsUp(dev NetDevice) bool {
+	return dev.Info().IsUp()
+}
 
-	if !dev.Info().IsUp() {
-		util.Errorf("not opened, dev=%s", dev.Info().Name)
-		return false
+func (stack *Stack) NetDeviceOutput(dev NetDevice, typ NetProtocolType, data []uint8, dst any) error {
+	logNet.Debugf("dev=%s, type=0x%04x, %d", dev.Info().Name, typ, len(data))
+	logNet.Dump("", data, stack.dumpNet(dev, typ))
+
+	if !stack.NetDeviceIsUp(dev) {
+		logNet.Errorf("not opened, dev=%s", dev.Info().Name)
+		return fmt.Errorf("%w, dev=%s", ErrDeviceDown, dev.Info().Name)
 	}
 	if dev.Info().MTU < len(data) {
-		util.Errorf("too long, dev=%s, mtu=%d, len=%d", dev.Info().Name, dev.Info().MTU, len(data))
+		logNet.Errorf("too long, dev=%s, mtu=%d, len=%d", dev.Info().Name, dev.Info().MTU, len(data))
+		return fmt.Errorf("%w, dev=%s, mtu=%d, len=%d", ErrMTUExceeded, dev.Info().Name, dev.Info().MTU, len(data))
 	}
 
+	captureNet(dev, typ, data, captureOutbound)
+
 	if !dev.Output(typ, data, dst) {
-		util.Errorf("failure, dev=%s, mtu=%d, len=%d", dev.Info().Name, dev.Info().MTU, len(data))
-		return false
+		logNet.Errorf("failure, dev=%s, mtu=%d, len=%d", dev.Info().Name, dev.Info().MTU, len(data))
+		return fmt.Errorf("%w: output failure, dev=%s", ErrDeviceIO, dev.Info().Name)
 	}
 
-	return true
+	return nil
 }
 
-// NOTE: NetRun() より前に呼び出すこと
-func NetDeviceAddIface(dev NetDevice, iface NetIface) bool {
+func (stack *Stack) NetDeviceAddIface(dev NetDevice, iface NetIface) error {
+	stack.net.mutex.Lock()
+	defer stack.net.mutex.Unlock()
+
 	for _, entry := range dev.Info().ifaces {
 		if entry.Info().Family == iface.Info().Family {
 			// NOTE: 簡単のために、１つのファミリのインタフェースは１つのみ紐づけ可能とする
-			util.Errorf("already exists, dev=%s, family=%d", dev.Info().Name, entry.Info().Family)
-			return false
+			logNet.Errorf("already exists, dev=%s, family=%d", dev.Info().Name, entry.Info().Family)
+			return fmt.Errorf("%w, dev=%s, family=%d", ErrAlreadyExists, dev.Info().Name, entry.Info().Family)
 		}
 	}
 
 	dev.Info().ifaces = append(dev.Info().ifaces, iface)
 	iface.Info().Dev = dev
 
-	util.Infof("success, dev=%s", dev.Info().Name)
-	return true
+	logNet.Infof("success, dev=%s", dev.Info().Name)
+	return nil
 }
 
-func NetDeviceGetIface(dev NetDevice, family NetIfaceFamily) NetIface {
+// 書籍には無い機能
+func (stack *Stack) NetDeviceDelIface(dev NetDevice, iface NetIface) error {
+	stack.net.mutex.Lock()
+	defer stack.net.mutex.Unlock()
+
+	idx := slices.Index(dev.Info().ifaces, iface)
+	if idx < 0 {
+		logNet.Errorf("not found, dev=%s, family=%d", dev.Info().Name, iface.Info().Family)
+		return fmt.Errorf("%w, dev=%s, family=%d", ErrNotFound, dev.Info().Name, iface.Info().Family)
+	}
+	dev.Info().ifaces = slices.Delete(dev.Info().ifaces, idx, idx+1)
+
+	logNet.Infof("success, dev=%s", dev.Info().Name)
+	return nil
+}
+
+func (stack *Stack) NetDeviceGetIface(dev NetDevice, family NetIfaceFamily) NetIface {
+	stack.net.mutex.RLock()
+	defer stack.net.mutex.RUnlock()
+
 	for _, entry := range dev.Info().ifaces {
 		if entry.Info().Family == family {
 			return entry
@@ -211,85 +375,231 @@ func NetDeviceGetIface(dev NetDevice, family NetIfaceFamily) NetIface {
 	return nil
 }
 
-// NOTE: NetRun() より前に呼び出すこと
-func NetProtocolRegister(proto NetProtocol) bool {
-	for _, p := range Protocols {
+// NOTE: NetRun() の後に登録した場合も、登録した直後から受信したデータを処理する
+func (stack *Stack) NetProtocolRegister(proto NetProtocol) error {
+	stack.net.mutex.Lock()
+	defer stack.net.mutex.Unlock()
+
+	for _, p := range stack.net.protocols {
 		if proto.Info().Typ == p.Info().Typ {
-			util.Errorf("already registerd, type=0x%04d", p.Info().Typ)
-			return false
+			logNet.Errorf("already registered, type=0x%04x", p.Info().Typ)
+			return fmt.Errorf("%w, type=0x%04x", ErrAlreadyExists, p.Info().Typ)
 		}
 	}
-	Protocols = append(Protocols, proto)
+	proto.Info().stack = stack
+	stack.net.protocols = append(stack.net.protocols, proto)
 
-	util.Infof("success, type=0x%04x", proto.Info().Typ)
-	return true
+	logNet.Infof("success, type=0x%04x", proto.Info().Typ)
+	return nil
 }
 
-func NetInput(typ NetProtocolType, data []uint8, dev NetDevice) bool {
-	util.Debugf("dev=%s, type=0x%04x, len=%d", dev.Info().Name, typ, len(data))
-	util.DebugDump(data)
+// 書籍では net_timer_register()
+func (stack *Stack) NetTimerRegister(name string, interval time.Duration, handler NetTimerHandler) error {
+	timer := netTimer{
+		name:     name,
+		interval: interval,
+		last:     time.Now(),
+		handler:  handler,
+	}
+
+	stack.net.mutex.Lock()
+	stack.net.timers = append(stack.net.timers, &timer)
+	stack.net.mutex.Unlock()
+
+	logNet.Infof("registered: %s, interval=%s", timer.name, timer.interval)
+	return nil
+}
 
-	for _, proto := range Protocols {
-		if proto.Info().Typ == typ {
-			proto.InputHandler(data, dev)
-			return true
+// 割り込みルーチンから定期的に呼び出される
+// NOTE: ハンドラからロックを取得できるように、リストを複製してからロックを解放して呼び出す
+// 書籍では net_timer_handler()
+func (stack *Stack) netTimerHandler() {
+	stack.net.mutex.RLock()
+	entries := slices.Clone(stack.net.timers)
+	stack.net.mutex.RUnlock()
+
+	now := time.Now()
+	for _, timer := range entries {
+		// NOTE: last は割り込みルーチンからのみ参照する
+		if now.Sub(timer.last) >= timer.interval {
+			timer.handler()
+			timer.last = now
 		}
 	}
+}
 
-	// 未サポートのプロトコルの場合はここを通る
-	return true
+// 書籍では net_event_subscribe()
+func (stack *Stack) NetEventSubscribe(handler NetEventHandler, arg any) error {
+	stack.net.mutex.Lock()
+	defer stack.net.mutex.Unlock()
+
+	stack.net.events = append(stack.net.events, netEvent{handler: handler, arg: arg})
+	return nil
 }
 
-func NetInit() bool {
-	util.Infof("initialize...")
+// イベントを発生させる
+// NOTE: 任意のルーチンから呼び出してよい。ハンドラは割り込みルーチンで呼び出される
+// 書籍では net_raise_event()
+func (stack *Stack) NetRaiseEvent() error {
+	stack.intrRaiseEvent()
+	return nil
+}
 
-	if !PlatformInit() {
-		util.Errorf("platformInit() failure")
-		return false
+// 書籍では net_event_handler()
+func (stack *Stack) netEventHandler() {
+	stack.net.mutex.RLock()
+	entries := slices.Clone(stack.net.events)
+	stack.net.mutex.RUnlock()
+
+	for _, event := range entries {
+		event.handler(event.arg)
 	}
+}
+
+// NOTE: プロトコルの受信キューに格納してソフトウェア割り込みを発生させ、受信処理はソフトウェア割り込みのハンドラで行う
+// 書籍では net_input_handler()
+func (stack *Stack) NetInput(typ NetProtocolType, data []uint8, dev NetDevice) error {
+	captureNet(dev, typ, data, captureInbound)
 
-	if !IPInit() {
-		util.Errorf("ipInit() failure")
-		return false
+	if impair := dev.Info().impair.Load(); impair != nil {
+		// デバイスが包まれている場合は、障害を与えてから受信キューに格納する
+		impair.input(typ, data, dev)
+		return nil
 	}
+	return stack.netInput(typ, data, dev)
+}
 
-	if !ICMPInit() {
-		util.Errorf("icmpInit() failure")
-		return false
+// NetInput() の本体（デバイスに障害を与える処理から呼び出す）
+func (stack *Stack) netInput(typ NetProtocolType, data []uint8, dev NetDevice) error {
+	stack.net.mutex.RLock()
+	idx := slices.IndexFunc(stack.net.protocols, func(proto NetProtocol) bool {
+		return proto.Info().Typ == typ
+	})
+	if idx < 0 {
+		stack.net.mutex.RUnlock()
+		// 未サポートのプロトコルの場合はここを通る
+		return nil
+	}
+	info := stack.net.protocols[idx].Info()
+	stack.net.mutex.RUnlock()
+
+	info.mutex.Lock()
+	if NetProtocolQueueSizeMax <= len(info.queue) {
+		info.drops++
+		drops := info.drops
+		info.mutex.Unlock()
+		logNet.Errorf("queue is full, dev=%s, type=0x%04x, drops=%d", dev.Info().Name, typ, drops)
+		return fmt.Errorf("%w, dev=%s, type=0x%04x", ErrQueueFull, dev.Info().Name, typ)
 	}
+	// 呼び出し元がバッファを再利用しても問題無いようにコピーして保持する
+	info.queue = append(info.queue, netProtocolQueueEntry{dev: dev, data: slices.Clone(data)})
+	num := len(info.queue)
+	info.mutex.Unlock()
+
+	logNet.Debugf("queue pushed (num:%d), dev=%s, type=0x%04x, len=%d", num, dev.Info().Name, typ, len(data))
+	logNet.Dump("", data, stack.dumpNet(dev, typ))
 
-	util.Infof("success")
-	return true
+	stack.intrRaiseSoftIRQ()
+	return nil
 }
 
-func NetRun() bool {
-	util.Infof("startup...")
+// 受信キューのエントリをすべて取り出す
+func (proto *NetProtocolInfo) dequeueAll() []netProtocolQueueEntry {
+	proto.mutex.Lock()
+	defer proto.mutex.Unlock()
+
+	entries := proto.queue
+	proto.queue = nil
+	return entries
+}
 
-	if !PlatformRun() {
-		util.Errorf("platformRun() failure")
-		return false
+// ソフトウェア割り込みのハンドラ
+// 書籍では net_softirq_handler()
+func (stack *Stack) netSoftIRQHandler() {
+	stack.net.mutex.RLock()
+	protocols := slices.Clone(stack.net.protocols)
+	stack.net.mutex.RUnlock()
+
+	for _, proto := range protocols {
+		for _, entry := range proto.Info().dequeueAll() {
+			logNet.Debugf("queue popped, dev=%s, type=0x%04x, len=%d", entry.dev.Info().Name, proto.Info().Typ, len(entry.data))
+			logNet.Dump("", entry.data, stack.dumpNet(entry.dev, proto.Info().Typ))
+			proto.InputHandler(entry.data, entry.dev)
+		}
+	}
+}
+
+func (stack *Stack) NetInit() error {
+	logNet.Infof("initialize...")
+
+	if err := stack.PlatformInit(); err != nil {
+		logNet.Errorf("platformInit() failure")
+		return err
+	}
+
+	if err := stack.ARPInit(); err != nil {
+		logNet.Errorf("arpInit() failure")
+		return err
+	}
+
+	if err := stack.IPInit(); err != nil {
+		logNet.Errorf("ipInit() failure")
+		return err
+	}
+
+	if err := stack.ICMPInit(); err != nil {
+		logNet.Errorf("icmpInit() failure")
+		return err
+	}
+
+	if err := stack.UDPInit(); err != nil {
+		logNet.Errorf("udpInit() failure")
+		return err
 	}
 
-	for i := range Devices {
-		NetDeviceOpen(Devices[i])
+	if err := stack.TCPInit(); err != nil {
+		logNet.Errorf("tcpInit() failure")
+		return err
 	}
 
-	util.Infof("success")
-	return true
+	logNet.Infof("success")
+	return nil
+}
+
+func (stack *Stack) NetRun() error {
+	logNet.Infof("startup...")
+
+	if err := stack.PlatformRun(); err != nil {
+		logNet.Errorf("platformRun() failure")
+		return err
+	}
+
+	for _, dev := range stack.Devices() {
+		stack.NetDeviceOpen(dev)
+	}
+
+	logNet.Infof("success")
+	return nil
 }
 
-func NetShutdown() bool {
-	util.Infof("shutting down...")
+func (stack *Stack) NetShutdown() error {
+	logNet.Infof("shutting down...")
 
-	if !PlatformShutdown() {
-		util.Errorf("platformShutdown() failure")
-		return false
+	if err := stack.PlatformShutdown(); err != nil {
+		logNet.Errorf("platformShutdown() failure")
+		return err
 	}
 
-	for i := range Devices {
-		NetDeviceClose(Devices[i])
+	// ブロックしているユーザーコマンドを中断させる
+	// NOTE: 割り込みルーチンは停止しているため、イベントハンドラを直接呼び出す
+	stack.netEventHandler()
+
+	for _, dev := range stack.Devices() {
+		if stack.NetDeviceIsUp(dev) {
+			stack.NetDeviceClose(dev)
+		}
 	}
 
-	util.Infof("success")
-	return true
+	logNet.Infof("success")
+	return nil
 }
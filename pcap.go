@@ -0,0 +1,308 @@
+package microps
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bugph0bia/go-microps/internal/pcap"
+)
+
+// ----------------------------------------------------------------------------
+// pcap ファイルのデバイス（書籍には無い機能）
+//
+// NOTE:
+//   pcap ファイルから読み込んだデータを受信したものとして NetInput() に渡し、送信したデータを別の pcap ファイルに書き込む
+//   キャプチャした通信を TAP デバイス無しで再現して、プロトコルの受信処理を決まった順序で試験するために使う
+//   受信データは１つずつ割り込みハンドラで処理し、その都度ソフトウェア割り込みの処理まで行うため、キャプチャの順序どおりに処理される
+// ----------------------------------------------------------------------------
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+// 読み込んで未処理のデータのキューの長さ（超える場合は処理を待つ）
+const PcapQueueSizeMax = 64
+
+// ループバックのリンク種別のヘッダ（アドレスファミリ）
+const (
+	pcapLoopbackHdrSize = 4
+	pcapAddrFamilyInet  = 2 // AF_INET
+)
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+type PcapOptions struct {
+	Addr     string // Ethernet アドレス（空文字列の場合はランダム）
+	Realtime bool   // キャプチャした時刻の間隔どおりに受信する（false の場合は待たずに受信する）
+}
+
+// pcap ファイルのデバイス
+type PcapDevice struct {
+	NetDeviceInfo
+	irq      IntrIRQ
+	opts     PcapOptions
+	linkType pcap.LinkType
+	reader   *pcap.Reader
+	frames   chan []uint8 // 読み込んで未処理のデータ（nil はファイルの終端）
+	current  []uint8      // 割り込みハンドラで処理中のデータ
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	done     chan struct{}
+	doneOnce sync.Once
+	wmutex   sync.Mutex
+	writer   *pcap.Writer
+}
+
+func (dev *PcapDevice) Info() *NetDeviceInfo {
+	return &dev.NetDeviceInfo
+}
+
+// 読み込みを開始する
+// NOTE: 停止した後に再び開始した場合は続きから読み込む
+func (dev *PcapDevice) Open() bool {
+	if dev.reader == nil {
+		return true
+	}
+	dev.stop = make(chan struct{})
+	dev.wg.Add(1)
+	go dev.replay(dev.stop)
+	return true
+}
+
+func (dev *PcapDevice) Close() bool {
+	if dev.stop != nil {
+		close(dev.stop)
+		dev.wg.Wait()
+		dev.stop = nil
+	}
+	return true
+}
+
+func (dev *PcapDevice) Output(typ NetProtocolType, data []uint8, dst any) bool {
+	if dev.linkType == pcap.LinkTypeEthernet {
+		return EtherOutputHelper(dev, typ, data, dst, pcapTransmit)
+	}
+
+	if typ != NetProtocolTypeIP {
+		logNet.Errorf("unsupported protocol, dev=%s, type=0x%04x", dev.Name, typ)
+		return false
+	}
+	var hdr []uint8
+	switch dev.linkType {
+	case pcap.LinkTypeNull:
+		hdr = binary.NativeEndian.AppendUint32(nil, pcapAddrFamilyInet)
+	case pcap.LinkTypeLoop:
+		hdr = binary.BigEndian.AppendUint32(nil, pcapAddrFamilyInet)
+	}
+	return pcapTransmit(dev, append(hdr, data...))
+}
+
+// ファイルの終端まで読み込み、すべてのデータを処理し終えたときに閉じるチャネル
+func (dev *PcapDevice) Done() <-chan struct{} {
+	return dev.done
+}
+
+func (dev *PcapDevice) finish() {
+	dev.doneOnce.Do(func() { close(dev.done) })
+}
+
+// pcap ファイルからデータを読み込んで受信キューに格納する
+func (dev *PcapDevice) replay(stop <-chan struct{}) {
+	defer dev.wg.Done()
+
+	var first time.Time
+	var start time.Time
+	for {
+		record, err := dev.reader.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logNet.Errorf("read failure, dev=%s, err=%v", dev.Name, err)
+			}
+			// 終端を通知する
+			select {
+			case dev.frames <- nil:
+				dev.stack.intrRaise(dev.irq)
+			case <-stop:
+			}
+			return
+		}
+
+		if dev.opts.Realtime {
+			if first.IsZero() {
+				first, start = record.Time, time.Now()
+			}
+			wait := time.Until(start.Add(record.Time.Sub(first)))
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-stop:
+					return
+				}
+			}
+		}
+
+		select {
+		case dev.frames <- record.Data:
+			dev.stack.intrRaise(dev.irq)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+func pcapTransmit(dev NetDevice, frame []uint8) bool {
+	pdev := dev.(*PcapDevice)
+	if pdev.writer == nil {
+		// 書き込み先が無い場合は破棄する
+		return true
+	}
+
+	pdev.wmutex.Lock()
+	defer pdev.wmutex.Unlock()
+
+	if err := pdev.writer.Write(time.Now(), frame); err != nil {
+		logNet.Errorf("write failure, dev=%s, err=%v", pdev.Name, err)
+		return false
+	}
+	return true
+}
+
+func pcapRead(dev NetDevice, buf []uint8) (int, bool) {
+	pdev := dev.(*PcapDevice)
+	return copy(buf, pdev.current), true
+}
+
+// 読み込んだデータを受信する
+// NOTE: ループバックのリンク種別と IP のリンク種別では、IPv4 以外のデータは無視する
+func pcapInput(dev *PcapDevice, data []uint8) {
+	switch dev.linkType {
+	case pcap.LinkTypeNull, pcap.LinkTypeLoop:
+		if len(data) < pcapLoopbackHdrSize {
+			logNet.Errorf("too short, dev=%s, len=%d", dev.Name, len(data))
+			return
+		}
+		// NOTE: LinkTypeNull はキャプチャしたホストのバイトオーダーのため、どちらのバイトオーダーでも判定する
+		family := binary.BigEndian.Uint32(data)
+		if dev.linkType == pcap.LinkTypeNull && family != pcapAddrFamilyInet {
+			family = binary.LittleEndian.Uint32(data)
+		}
+		if family != pcapAddrFamilyInet {
+			return
+		}
+		data = data[pcapLoopbackHdrSize:]
+	}
+	if len(data) == 0 || data[0]>>4 != IPVersionIPV4 {
+		return
+	}
+	dev.stack.NetInput(NetProtocolTypeIP, data, dev)
+}
+
+// 割り込みハンドラ
+func pcapISR(irq IntrIRQ, dev NetDevice) {
+	pdev, ok := dev.(*PcapDevice)
+	if !ok {
+		logNet.Errorf("not pcap device, dev=%s", dev.Info().Name)
+		return
+	}
+
+	// IRQ はまとめて通知されることがあるため、キューが空になるまで処理する
+	for len(pdev.frames) > 0 {
+		data := <-pdev.frames
+		if data == nil {
+			// ファイルの終端まですべて処理した
+			pdev.finish()
+			continue
+		}
+
+		if pdev.linkType == pcap.LinkTypeEthernet {
+			pdev.current = data
+			EtherInputHelper(pdev, pcapRead)
+			pdev.current = nil
+		} else {
+			pcapInput(pdev, data)
+		}
+		// NOTE: 次のデータを受信する前に、受信したデータの処理（ソフトウェア割り込み）を終わらせる
+		pdev.stack.netSoftIRQHandler()
+	}
+}
+
+// pcap ファイルのデバイスを生成する
+// r から読み込んだデータを受信し、送信したデータを w に書き込む（どちらも nil を指定できる）
+// NOTE: リンク種別は r のリンク種別に従い、w にも同じリンク種別で書き込む（r が nil の場合は Ethernet）
+// NOTE: r と w はデバイスを停止した後に呼び出し元で閉じること
+func (stack *Stack) PcapInit(r io.Reader, w io.Writer, opts PcapOptions) (*PcapDevice, error) {
+	dev := PcapDevice{
+		irq:      stack.intrIRQAlloc(),
+		opts:     opts,
+		linkType: pcap.LinkTypeEthernet,
+		frames:   make(chan []uint8, PcapQueueSizeMax),
+		done:     make(chan struct{}),
+	}
+
+	if r != nil {
+		reader, err := pcap.NewReader(r)
+		if err != nil {
+			logNet.Errorf("pcap.NewReader() failure, err=%v", err)
+			return nil, fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+		}
+		dev.reader = reader
+		dev.linkType = reader.LinkType()
+	} else {
+		dev.finish()
+	}
+
+	switch dev.linkType {
+	case pcap.LinkTypeEthernet:
+		EtherSetup(&dev)
+		hwaddr := etherAddrRandom()
+		if opts.Addr != "" {
+			var ok bool
+			hwaddr, ok = ParseEtherAddr(opts.Addr)
+			if !ok {
+				logNet.Errorf("ParseEtherAddr() failure, addr=%s", opts.Addr)
+				return nil, fmt.Errorf("%w, addr=%s", ErrInvalidAddr, opts.Addr)
+			}
+		}
+		copy(dev.Addr[:], hwaddr[:])
+	case pcap.LinkTypeNull, pcap.LinkTypeLoop, pcap.LinkTypeRaw, pcap.LinkTypeIPv4:
+		dev.Typ = NetDeviceTypeDummy
+		dev.MTU = math.MaxUint16
+		dev.Flags = NetDeviceFlagP2p
+	default:
+		logNet.Errorf("unsupported link type, linktype=%d", dev.linkType)
+		return nil, fmt.Errorf("%w: unsupported link type, linktype=%d", ErrInvalidArgument, dev.linkType)
+	}
+
+	if w != nil {
+		writer, err := pcap.NewWriter(w, dev.linkType, pcap.SnapLenDefault)
+		if err != nil {
+			logNet.Errorf("pcap.NewWriter() failure, err=%v", err)
+			return nil, fmt.Errorf("%w: %w", ErrDeviceIO, err)
+		}
+		dev.writer = writer
+	}
+
+	if err := stack.NetDeviceRegister(&dev); err != nil {
+		logNet.Errorf("NetDeviceRegister() failure")
+		return nil, err
+	}
+
+	if err := stack.intrRegister(dev.irq, pcapISR, IntrIRQFlagShared, &dev); err != nil {
+		logNet.Errorf("intrRegister() failure, dev=%s", dev.Name)
+		return nil, err
+	}
+
+	logNet.Infof("pcap device initialized, dev=%s, linktype=%d", dev.Name, dev.linkType)
+	return &dev, nil
+}
@@ -1,13 +1,25 @@
 package microps
 
-func PlatformInit() bool {
-	return true
+func (stack *Stack) PlatformInit() error {
+	if err := stack.intrInit(); err != nil {
+		logIntr.Errorf("intrInit() failure")
+		return err
+	}
+	return nil
 }
 
-func PlatformRun() bool {
-	return true
+func (stack *Stack) PlatformRun() error {
+	if err := stack.intrRun(); err != nil {
+		logIntr.Errorf("intrRun() failure")
+		return err
+	}
+	return nil
 }
 
-func PlatformShutdown() bool {
-	return true
+func (stack *Stack) PlatformShutdown() error {
+	if err := stack.intrShutdown(); err != nil {
+		logIntr.Errorf("intrShutdown() failure")
+		return err
+	}
+	return nil
 }
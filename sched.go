@@ -0,0 +1,77 @@
+package microps
+
+import (
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// タスクの休止と再開を管理する構造体
+// 書籍では struct sched_ctx
+type schedCtx struct {
+	cond        sync.Cond
+	interrupted bool
+	wc          int // wait count
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// NOTE: mutex は休止中に解放されるロックであり、以降の関数はこれをロックした状態で呼び出すこと
+func (ctx *schedCtx) init(mutex *sync.Mutex) {
+	ctx.cond.L = mutex
+	ctx.interrupted = false
+	ctx.wc = 0
+}
+
+// 休止中のタスクが存在する場合は false を返す
+func (ctx *schedCtx) destroy() bool {
+	return ctx.wc == 0
+}
+
+// NOTE: deadline にゼロ値を指定した場合はタイムアウトしない
+// NOTE: 中断された場合は false を返す。タイムアウトの判定は呼び出し元で行うこと
+func (ctx *schedCtx) sleep(deadline time.Time) bool {
+	if ctx.interrupted {
+		return false
+	}
+
+	if !deadline.IsZero() {
+		if !time.Now().Before(deadline) {
+			return true
+		}
+		// sync.Cond にはタイムアウトが無いため、期限になったら起床させる
+		// NOTE: Wait() に入る前に起床の通知が失われないよう、ロックを取得してから通知する
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			ctx.cond.L.Lock()
+			defer ctx.cond.L.Unlock()
+			ctx.cond.Broadcast()
+		})
+		defer timer.Stop()
+	}
+
+	ctx.wc++
+	ctx.cond.Wait()
+	ctx.wc--
+
+	if ctx.interrupted {
+		if ctx.wc == 0 {
+			ctx.interrupted = false
+		}
+		return false
+	}
+	return true
+}
+
+func (ctx *schedCtx) wakeup() {
+	ctx.cond.Broadcast()
+}
+
+func (ctx *schedCtx) interrupt() {
+	ctx.interrupted = true
+	ctx.cond.Broadcast()
+}
@@ -0,0 +1,40 @@
+package microps
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// プロトコルスタックの生成オプション
+type Options struct {
+	IPForwarding bool // IPフォワーディング（ルーターとして動作する）の有効/無効
+}
+
+// プロトコルスタック（書籍には無い機能）
+// NOTE:
+// 書籍ではプロトコルスタックの状態をグローバル変数で保持するが、
+// １つのプロセスで複数のホストを模擬できるように、すべての状態をインスタンスで保持する
+type Stack struct {
+	net   netState
+	intr  intrState
+	arp   arpState
+	ip    ipState
+	reass ipReassState
+	udp   udpState
+	tcp   tcpState
+	dump  dumpState
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// NOTE: 生成した後に NetInit() を呼び出すこと
+func New(opts Options) *Stack {
+	stack := Stack{}
+	stack.intr.init()
+	stack.reass.init()
+	stack.ip.forwarding.Store(opts.IPForwarding)
+
+	logNet.Infof("created, forwarding=%t", opts.IPForwarding)
+	return &stack
+}
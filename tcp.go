@@ -0,0 +1,1388 @@
+package microps
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+const TCPHdrSizeMin = 20
+const TCPPseudoHdrSize = 12
+
+const TCPPCBSize = 16
+
+// 受信バッファのサイズ
+const TCPBufSize = 65535
+
+// エフェメラルポートの範囲
+const (
+	TCPSourcePortMin = 49152
+	TCPSourcePortMax = 65535
+)
+
+const TCPTimewaitTimeout = 30 * time.Second
+
+// 再送タイムアウト (RFC 6298)
+const (
+	TCPRTOInitial = 1 * time.Second
+	TCPRTOMin     = 1 * time.Second
+	TCPRTOMax     = 60 * time.Second
+)
+
+// 確認応答が進まないまま再送する回数の上限（超えた場合は接続を中断する）
+const TCPRetransmitCountMax = 8
+
+// TCPタイマーの周期（RTO 計算時のクロック粒度 G を兼ねる）
+const TCPTimerInterval = 100 * time.Millisecond
+
+// TCPフラグ
+const (
+	TCPFlgFIN uint8 = 0x01
+	TCPFlgSYN uint8 = 0x02
+	TCPFlgRST uint8 = 0x04
+	TCPFlgPSH uint8 = 0x08
+	TCPFlgACK uint8 = 0x10
+	TCPFlgURG uint8 = 0x20
+)
+
+// TCP PCB の状態
+type TCPPCBState uint8
+
+const (
+	TCPPCBStateFree TCPPCBState = iota
+	TCPPCBStateClosed
+	TCPPCBStateListen
+	TCPPCBStateSynSent
+	TCPPCBStateSynReceived
+	TCPPCBStateEstablished
+	TCPPCBStateFinWait1
+	TCPPCBStateFinWait2
+	TCPPCBStateClosing
+	TCPPCBStateTimeWait
+	TCPPCBStateCloseWait
+	TCPPCBStateLastAck
+)
+
+var tcpPCBStateStrings = map[TCPPCBState]string{
+	TCPPCBStateFree:        "FREE",
+	TCPPCBStateClosed:      "CLOSED",
+	TCPPCBStateListen:      "LISTEN",
+	TCPPCBStateSynSent:     "SYN_SENT",
+	TCPPCBStateSynReceived: "SYN_RECEIVED",
+	TCPPCBStateEstablished: "ESTABLISHED",
+	TCPPCBStateFinWait1:    "FIN_WAIT1",
+	TCPPCBStateFinWait2:    "FIN_WAIT2",
+	TCPPCBStateClosing:     "CLOSING",
+	TCPPCBStateTimeWait:    "TIME_WAIT",
+	TCPPCBStateCloseWait:   "CLOSE_WAIT",
+	TCPPCBStateLastAck:     "LAST_ACK",
+}
+
+func (state TCPPCBState) String() string {
+	if str, ok := tcpPCBStateStrings[state]; ok {
+		return str
+	} else {
+		return "UNKNOWN"
+	}
+}
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// TCP疑似ヘッダ
+type TCPPseudoHdr struct {
+	Src      IPAddr
+	Dst      IPAddr
+	Zero     uint8
+	Protocol uint8
+	Len      uint16
+}
+
+func (hdr *TCPPseudoHdr) Marshal(b []uint8) {
+	binary.NativeEndian.PutUint32(b[0:], uint32(hdr.Src))
+	binary.NativeEndian.PutUint32(b[4:], uint32(hdr.Dst))
+	b[8] = hdr.Zero
+	b[9] = hdr.Protocol
+	binary.NativeEndian.PutUint16(b[10:], hdr.Len)
+}
+
+// TCPヘッダ
+type TCPHdr struct {
+	Src uint16 // Source Port
+	Dst uint16 // Destination Port
+	Seq uint32 // Sequence Number
+	Ack uint32 // Acknowledgment Number
+	Off uint8  // Data Offset
+	Flg uint8  // Control Flags
+	Wnd uint16 // Window
+	Sum uint16 // Checksum
+	Up  uint16 // Urgent Pointer
+}
+
+// NOTE: オプションは含まない
+func (hdr *TCPHdr) Marshal(b []uint8) {
+	binary.NativeEndian.PutUint16(b[0:], hdr.Src)
+	binary.NativeEndian.PutUint16(b[2:], hdr.Dst)
+	binary.NativeEndian.PutUint32(b[4:], hdr.Seq)
+	binary.NativeEndian.PutUint32(b[8:], hdr.Ack)
+	b[12] = hdr.Off
+	b[13] = hdr.Flg
+	binary.NativeEndian.PutUint16(b[14:], hdr.Wnd)
+	binary.NativeEndian.PutUint16(b[16:], hdr.Sum)
+	binary.NativeEndian.PutUint16(b[18:], hdr.Up)
+}
+
+func (hdr *TCPHdr) Unmarshal(b []uint8) bool {
+	if len(b) < TCPHdrSizeMin {
+		return false
+	}
+	hdr.Src = binary.NativeEndian.Uint16(b[0:])
+	hdr.Dst = binary.NativeEndian.Uint16(b[2:])
+	hdr.Seq = binary.NativeEndian.Uint32(b[4:])
+	hdr.Ack = binary.NativeEndian.Uint32(b[8:])
+	hdr.Off = b[12]
+	hdr.Flg = b[13]
+	hdr.Wnd = binary.NativeEndian.Uint16(b[14:])
+	hdr.Sum = binary.NativeEndian.Uint16(b[16:])
+	hdr.Up = binary.NativeEndian.Uint16(b[18:])
+	return true
+}
+
+// 受信したセグメントの情報（ホストバイトオーダー）
+type tcpSegmentInfo struct {
+	seq uint32
+	ack uint32
+	len uint32 // SYN, FIN を含むセグメント長
+	wnd uint16
+	up  uint16
+}
+
+// 再送キューのエントリ
+type tcpQueueEntry struct {
+	first time.Time // 初回の送信時刻
+	retry int       // 再送回数
+	seq   uint32
+	flg   uint8
+	data  []uint8
+}
+
+// セグメントが消費するシーケンス番号の長さ
+func (entry *tcpQueueEntry) len() uint32 {
+	l := uint32(len(entry.data))
+	if entry.flg&TCPFlgSYN > 0 {
+		l++
+	}
+	if entry.flg&TCPFlgFIN > 0 {
+		l++
+	}
+	return l
+}
+
+// TCP PCB (Protocol Control Block)
+type tcpPCB struct {
+	state   TCPPCBState
+	local   IPEndpoint
+	foreign IPEndpoint
+	snd     struct {
+		nxt uint32
+		una uint32
+		wnd uint16
+		up  uint16
+		wl1 uint32
+		wl2 uint32
+	}
+	iss uint32
+	rcv struct {
+		nxt uint32
+		wnd uint16
+		up  uint16
+	}
+	irs      uint32
+	buf      []uint8 // 受信バッファ
+	ctx      schedCtx
+	twTimer  time.Time       // TIME_WAIT の終了時刻
+	parent   *tcpPCB         // パッシブオープンした場合のリスナー
+	backlog  []*tcpPCB       // 接続が確立して Accept を待っている PCB
+	nbacklog int             // backlog の最大数
+	queue    []tcpQueueEntry // 再送キュー
+	rtxTimer time.Time       // 再送タイマーの満了時刻（ゼロ値は停止中）
+	rtxCount int             // SND.UNA が進まないまま再送タイマーが満了した回数
+	rto      time.Duration
+	srtt     time.Duration
+	rttvar   time.Duration
+	rtt      struct {
+		active bool      // RTT を計測中か
+		seq    uint32    // 計測対象のセグメントの末尾
+		start  time.Time // 計測対象のセグメントの送信時刻
+	}
+	err      error // 接続が中断された原因（書籍には無い機能）
+	detached bool  // ユーザーが TCPClose() で手放したか（書籍には無い機能）
+}
+
+// TCPプロトコル
+type TCPProtocol struct {
+	IPUpperProtocolInfo
+}
+
+func (proto *TCPProtocol) Info() *IPUpperProtocolInfo {
+	return &proto.IPUpperProtocolInfo
+}
+
+// 書籍では tcp_input()
+func (proto *TCPProtocol) InputHandler(ipHdr *IPHdr, data []uint8, packet []uint8, ipIface *IPIface) {
+	if len(data) < TCPHdrSizeMin {
+		logTCP.Errorf("too short")
+		return
+	}
+
+	var hdr TCPHdr
+	if !hdr.Unmarshal(data) {
+		logTCP.Errorf("Unmarshal() failure")
+		return
+	}
+
+	psum := tcpPseudoCksum(ipHdr.Src, ipHdr.Dst, len(data))
+	if util.Cksum16(data, psum) != 0 {
+		logTCP.Errorf("checksum error")
+		return
+	}
+
+	if ipHdr.Src == IPAddrBroadcast || ipHdr.Src == ipIface.broadcast ||
+		ipHdr.Dst == IPAddrBroadcast || ipHdr.Dst == ipIface.broadcast {
+		logTCP.Errorf("only supports unicast, src=%s, dst=%s", ipHdr.Src.String(), ipHdr.Dst.String())
+		return
+	}
+
+	hlen := int(hdr.Off>>4) << 2
+	if len(data) < hlen {
+		logTCP.Errorf("header length error: len=%d < hlen=%d", len(data), hlen)
+		return
+	}
+
+	logTCP.Debugf("%s:%d => %s:%d, len=%d (payload=%d)",
+		ipHdr.Src.String(), util.Ntoh16(hdr.Src), ipHdr.Dst.String(), util.Ntoh16(hdr.Dst), len(data), len(data)-hlen)
+	tcpPrint(data, proto.stack.dumpIPUpperProtocol(IPUpperProtocolTypeTCP))
+
+	local := IPEndpoint{Addr: ipHdr.Dst, Port: util.Ntoh16(hdr.Dst)}
+	foreign := IPEndpoint{Addr: ipHdr.Src, Port: util.Ntoh16(hdr.Src)}
+
+	seg := tcpSegmentInfo{
+		seq: util.Ntoh32(hdr.Seq),
+		ack: util.Ntoh32(hdr.Ack),
+		len: uint32(len(data) - hlen),
+		wnd: util.Ntoh16(hdr.Wnd),
+		up:  util.Ntoh16(hdr.Up),
+	}
+	if hdr.Flg&TCPFlgSYN > 0 {
+		seg.len++ // SYN はシーケンス番号を1つ消費する
+	}
+	if hdr.Flg&TCPFlgFIN > 0 {
+		seg.len++ // FIN はシーケンス番号を1つ消費する
+	}
+
+	stack := proto.stack
+
+	stack.tcp.mutex.Lock()
+	defer stack.tcp.mutex.Unlock()
+
+	stack.tcpSegmentArrives(&seg, hdr.Flg, data[hlen:], local, foreign)
+}
+
+// TCPの状態
+type tcpState struct {
+	pcbs  [TCPPCBSize]tcpPCB
+	mutex sync.Mutex
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// シーケンス番号の比較（ラップアラウンドを考慮する）
+func tcpSeqLT(a uint32, b uint32) bool { return int32(a-b) < 0 }
+func tcpSeqLE(a uint32, b uint32) bool { return int32(a-b) <= 0 }
+
+// 書籍では tcp_flg_ntoa()
+func tcpFlgString(flg uint8) string {
+	var sb strings.Builder
+	for i, c := range "--UAPRSF" {
+		if flg&(0x80>>i) > 0 {
+			sb.WriteRune(c)
+		} else {
+			sb.WriteRune('-')
+		}
+	}
+	return sb.String()
+}
+
+// NOTE: 16進ダンプは全体のダンプ出力が有効な場合のみ出力する
+func TCPPrint(data []uint8) {
+	tcpPrint(data, util.DumpEnabled())
+}
+
+func tcpPrint(data []uint8, hex bool) {
+	if !logTCP.Enabled(slog.LevelDebug) && !hex {
+		return
+	}
+
+	var hdr TCPHdr
+	if !hdr.Unmarshal(data) {
+		logTCP.Errorf("Unmarshal() failure")
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "        src: %d\n", util.Ntoh16(hdr.Src))
+	fmt.Fprintf(&sb, "        dst: %d\n", util.Ntoh16(hdr.Dst))
+	fmt.Fprintf(&sb, "        seq: %d\n", util.Ntoh32(hdr.Seq))
+	fmt.Fprintf(&sb, "        ack: %d\n", util.Ntoh32(hdr.Ack))
+	fmt.Fprintf(&sb, "        off: 0x%02x (%d)\n", hdr.Off, (hdr.Off>>4)<<2)
+	fmt.Fprintf(&sb, "        flg: 0x%02x (%s)\n", hdr.Flg, tcpFlgString(hdr.Flg))
+	fmt.Fprintf(&sb, "        wnd: %d\n", util.Ntoh16(hdr.Wnd))
+	fmt.Fprintf(&sb, "        sum: 0x%04x\n", util.Ntoh16(hdr.Sum))
+	fmt.Fprintf(&sb, "         up: %d\n", util.Ntoh16(hdr.Up))
+
+	logTCP.Dump(sb.String(), data, hex)
+}
+
+// 疑似ヘッダのチェックサムを計算して、チェックサムの初期値として返す
+func tcpPseudoCksum(src IPAddr, dst IPAddr, length int) uint32 {
+	pseudo := TCPPseudoHdr{
+		Src:      src,
+		Dst:      dst,
+		Zero:     0,
+		Protocol: uint8(IPUpperProtocolTypeTCP),
+		Len:      util.Hton16(uint16(length)),
+	}
+	var b [TCPPseudoHdrSize]uint8
+	pseudo.Marshal(b[:])
+	return util.Sum16(b[:], 0)
+}
+
+// 書籍では tcp_output_segment()
+func (stack *Stack) tcpOutputSegment(seq uint32, ack uint32, flg uint8, wnd uint16, data []uint8, local IPEndpoint, foreign IPEndpoint) (int, error) {
+	hdr := TCPHdr{
+		Src: util.Hton16(local.Port),
+		Dst: util.Hton16(foreign.Port),
+		Seq: util.Hton32(seq),
+		Ack: util.Hton32(ack),
+		Off: (TCPHdrSizeMin >> 2) << 4,
+		Flg: flg,
+		Wnd: util.Hton16(wnd),
+		Sum: 0,
+		Up:  0,
+	}
+	buf := make([]uint8, TCPHdrSizeMin+len(data))
+	hdr.Marshal(buf)
+	copy(buf[TCPHdrSizeMin:], data)
+
+	psum := tcpPseudoCksum(local.Addr, foreign.Addr, len(buf))
+	sum := util.Cksum16(buf, psum)
+	binary.NativeEndian.PutUint16(buf[16:], sum) // チェックサム値のバイトオーダー変換は行わない
+
+	logTCP.Debugf("%s => %s, len=%d (payload=%d)", local.String(), foreign.String(), len(buf), len(data))
+	tcpPrint(buf, stack.dumpIPUpperProtocol(IPUpperProtocolTypeTCP))
+
+	if _, err := stack.IPOutput(IPUpperProtocolTypeTCP, buf, local.Addr, foreign.Addr); err != nil {
+		logTCP.Errorf("IPOutput() failure")
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// 書籍では tcp_output()
+func (stack *Stack) tcpOutput(pcb *tcpPCB, flg uint8, data []uint8) (int, error) {
+	seq := pcb.snd.nxt
+	if flg&TCPFlgSYN > 0 {
+		seq = pcb.iss
+	}
+	queued := false
+	if flg&(TCPFlgSYN|TCPFlgFIN) > 0 || len(data) > 0 {
+		// シーケンス番号を消費するセグメントは確認応答されるまで再送キューに保持する
+		pcb.queueAdd(seq, flg, data)
+		queued = true
+	}
+	n, err := stack.tcpOutputSegment(seq, pcb.rcv.nxt, flg, pcb.rcv.wnd, data, pcb.local, pcb.foreign)
+	if queued && errors.Is(err, ErrARPIncomplete) {
+		// 書籍と同様、アドレス解決中に破棄されたセグメントは再送で補うため失敗としない
+		return len(data), nil
+	}
+	return n, err
+}
+
+// NOTE: 以降の tcpXxx() は tcp.mutex をロックした状態で呼び出すこと
+
+func (stack *Stack) tcpPCBAlloc() *tcpPCB {
+	for i := range stack.tcp.pcbs {
+		pcb := &stack.tcp.pcbs[i]
+		if pcb.state == TCPPCBStateFree {
+			pcb.state = TCPPCBStateClosed
+			pcb.rto = TCPRTOInitial
+			pcb.ctx.init(&stack.tcp.mutex)
+			return pcb
+		}
+	}
+	return nil
+}
+
+func (stack *Stack) tcpPCBRelease(pcb *tcpPCB) {
+	if !pcb.ctx.destroy() {
+		// 休止中のタスクが存在する場合は、起床させて最後に起床したタスクに解放させる
+		pcb.ctx.wakeup()
+		return
+	}
+
+	if pcb.err != nil && pcb.parent == nil && !pcb.detached {
+		// NOTE: 中断された原因をユーザーコマンドで返せるように、TCPClose() が呼び出されるまで CLOSED のまま保持する
+		logTCP.Debugf("keep closed, local=%s, foreign=%s, err=%s", pcb.local.String(), pcb.foreign.String(), pcb.err.Error())
+		return
+	}
+
+	if pcb.parent != nil {
+		// Accept される前に解放される場合は、リスナーの backlog から取り除く
+		pcb.parent.backlog = slices.DeleteFunc(pcb.parent.backlog, func(child *tcpPCB) bool {
+			return child == pcb
+		})
+	}
+
+	// Accept されていない PCB や、接続を確立中の子の PCB も解放する
+	for i := range stack.tcp.pcbs {
+		child := &stack.tcp.pcbs[i]
+		if child.state != TCPPCBStateFree && child.parent == pcb {
+			stack.tcpOutput(child, TCPFlgRST, nil)
+			child.parent = nil
+			child.state = TCPPCBStateClosed
+			stack.tcpPCBRelease(child)
+		}
+	}
+
+	logTCP.Debugf("released, local=%s, foreign=%s", pcb.local.String(), pcb.foreign.String())
+	*pcb = tcpPCB{}
+}
+
+// Accept されていない子の PCB の数（接続を確立中のものを含む）
+func (stack *Stack) tcpPCBChildCount(pcb *tcpPCB) int {
+	n := 0
+	for i := range stack.tcp.pcbs {
+		child := &stack.tcp.pcbs[i]
+		if child.state != TCPPCBStateFree && child.parent == pcb {
+			n++
+		}
+	}
+	return n
+}
+
+func (stack *Stack) tcpPCBSelect(local IPEndpoint, foreign *IPEndpoint) *tcpPCB {
+	var listen *tcpPCB
+	for i := range stack.tcp.pcbs {
+		pcb := &stack.tcp.pcbs[i]
+		if pcb.state == TCPPCBStateFree {
+			continue
+		}
+		if (pcb.local.Addr == IPAddrAny || pcb.local.Addr == local.Addr) && pcb.local.Port == local.Port {
+			if foreign == nil {
+				return pcb
+			}
+			if pcb.foreign.Addr == foreign.Addr && pcb.foreign.Port == foreign.Port {
+				return pcb
+			}
+			if pcb.state == TCPPCBStateListen {
+				if pcb.foreign.Addr == IPAddrAny && pcb.foreign.Port == 0 {
+					// ワイルドカードで待ち受けている PCB
+					listen = pcb
+				}
+			}
+		}
+	}
+	return listen
+}
+
+func (stack *Stack) tcpPCBGet(id int) *tcpPCB {
+	if id < 0 || len(stack.tcp.pcbs) <= id {
+		return nil
+	}
+	pcb := &stack.tcp.pcbs[id]
+	if pcb.state == TCPPCBStateFree {
+		return nil
+	}
+	return pcb
+}
+
+func (stack *Stack) tcpPCBID(pcb *tcpPCB) int {
+	for i := range stack.tcp.pcbs {
+		if &stack.tcp.pcbs[i] == pcb {
+			return i
+		}
+	}
+	return -1
+}
+
+// 受信バッファの空き容量を受信ウィンドウとする
+func (pcb *tcpPCB) updateRcvWnd() {
+	pcb.rcv.wnd = uint16(TCPBufSize - len(pcb.buf))
+}
+
+// 接続が閉じられた原因をエラーとして返す（書籍には無い機能）
+func (pcb *tcpPCB) closedErr(id int) error {
+	if pcb.err != nil {
+		return fmt.Errorf("%w, id=%d", pcb.err, id)
+	}
+	return fmt.Errorf("%w, id=%d", ErrClosed, id)
+}
+
+func (pcb *tcpPCB) enterTimewait() {
+	pcb.state = TCPPCBStateTimeWait
+	pcb.twTimer = time.Now().Add(TCPTimewaitTimeout)
+	pcb.ctx.wakeup()
+}
+
+// 書籍では tcp_retransmit_queue_add()
+func (pcb *tcpPCB) queueAdd(seq uint32, flg uint8, data []uint8) {
+	now := time.Now()
+	entry := tcpQueueEntry{
+		first: now,
+		seq:   seq,
+		flg:   flg,
+		data:  slices.Clone(data),
+	}
+	pcb.queue = append(pcb.queue, entry)
+
+	if !pcb.rtt.active {
+		// 同時に計測するセグメントは１つのみとする
+		pcb.rtt.active = true
+		pcb.rtt.seq = seq + entry.len()
+		pcb.rtt.start = now
+	}
+	if pcb.rtxTimer.IsZero() {
+		pcb.rtxTimer = now.Add(pcb.rto)
+	}
+}
+
+// RTT の計測値から RTO を更新する (RFC 6298 - section 2)
+func (pcb *tcpPCB) updateRTO(r time.Duration) {
+	if pcb.srtt == 0 {
+		pcb.srtt = r
+		pcb.rttvar = r / 2
+	} else {
+		pcb.rttvar = (3*pcb.rttvar + (pcb.srtt - r).Abs()) / 4
+		pcb.srtt = (7*pcb.srtt + r) / 8
+	}
+	pcb.rto = pcb.calcRTO()
+	logTCP.Debugf("rtt=%s, srtt=%s, rttvar=%s, rto=%s", r, pcb.srtt, pcb.rttvar, pcb.rto)
+}
+
+func (pcb *tcpPCB) calcRTO() time.Duration {
+	return min(max(pcb.srtt+max(TCPTimerInterval, 4*pcb.rttvar), TCPRTOMin), TCPRTOMax)
+}
+
+// SND.UNA が進んだ際に確認応答されたセグメントを再送キューから取り除く
+// 書籍では tcp_retransmit_queue_cleanup()
+func (pcb *tcpPCB) queueCleanup() {
+	now := time.Now()
+
+	n := 0
+	for _, entry := range pcb.queue {
+		if tcpSeqLT(pcb.snd.una, entry.seq+entry.len()) {
+			break
+		}
+		logTCP.Debugf("remove, seq=%d, flags=%s, len=%d", entry.seq, tcpFlgString(entry.flg), len(entry.data))
+		n++
+	}
+	pcb.queue = pcb.queue[n:]
+	if n > 0 {
+		// 通信が進んでいるため、再送の回数を数え直す
+		pcb.rtxCount = 0
+	}
+
+	if pcb.rtt.active && tcpSeqLE(pcb.rtt.seq, pcb.snd.una) {
+		pcb.rtt.active = false
+		pcb.updateRTO(now.Sub(pcb.rtt.start))
+	} else if n > 0 && pcb.srtt != 0 {
+		// NOTE:
+		// 再送したセグメントからは RTT を計測しないため、再送が続くとバックオフした RTO が戻らなくなる。
+		// 通信が進んだ場合は計測済みの SRTT と RTTVAR から RTO を計算し直す
+		pcb.rto = pcb.calcRTO()
+	}
+
+	if len(pcb.queue) == 0 {
+		pcb.rtxTimer = time.Time{}
+	} else if n > 0 {
+		// 新たなデータが確認応答された場合はタイマーを再始動する
+		pcb.rtxTimer = now.Add(pcb.rto)
+	}
+}
+
+// 再送タイマーが満了した場合に未確認のセグメントを再送する
+// NOTE: 受信側は順序が入れ替わったデータを破棄するため、先頭のセグメントだけでなく未確認のセグメントをすべて再送する
+// 書籍では tcp_retransmit_queue_emit()
+func (stack *Stack) tcpRetransmit(pcb *tcpPCB, now time.Time) {
+	if pcb.rtxTimer.IsZero() || now.Before(pcb.rtxTimer) || len(pcb.queue) == 0 {
+		return
+	}
+
+	// NOTE: 再送したセグメントごとではなく、確認応答が進まないまま満了した回数で中断を判断する
+	if TCPRetransmitCountMax <= pcb.rtxCount {
+		logTCP.Errorf("retransmission count exceeded, local=%s, foreign=%s", pcb.local.String(), pcb.foreign.String())
+		pcb.state = TCPPCBStateClosed
+		pcb.err = ErrTimeout
+		stack.tcpPCBRelease(pcb)
+		return
+	}
+
+	pcb.rtxCount++
+	for i := range pcb.queue {
+		entry := &pcb.queue[i]
+		entry.retry++
+		logTCP.Debugf("retransmit, seq=%d, flags=%s, len=%d, retry=%d", entry.seq, tcpFlgString(entry.flg), len(entry.data), entry.retry)
+		stack.tcpOutputSegment(entry.seq, pcb.rcv.nxt, entry.flg, pcb.rcv.wnd, entry.data, pcb.local, pcb.foreign)
+	}
+
+	// 再送したセグメントでは RTT を計測しない (Karn's algorithm)
+	pcb.rtt.active = false
+	pcb.rto = min(pcb.rto*2, TCPRTOMax)
+	pcb.rtxTimer = now.Add(pcb.rto)
+}
+
+// 書籍では tcp_timer()
+func (stack *Stack) tcpTimerHandler() {
+	stack.tcp.mutex.Lock()
+	defer stack.tcp.mutex.Unlock()
+
+	now := time.Now()
+	for i := range stack.tcp.pcbs {
+		pcb := &stack.tcp.pcbs[i]
+		switch pcb.state {
+		case TCPPCBStateFree, TCPPCBStateClosed, TCPPCBStateListen:
+			continue
+		case TCPPCBStateTimeWait:
+			if now.After(pcb.twTimer) {
+				logTCP.Debugf("timewait has elapsed, local=%s, foreign=%s", pcb.local.String(), pcb.foreign.String())
+				pcb.state = TCPPCBStateClosed
+				stack.tcpPCBRelease(pcb)
+			}
+			continue
+		}
+		stack.tcpRetransmit(pcb, now)
+	}
+}
+
+// RFC 793 - section 3.9 [Event Processing > SEGMENT ARRIVES]
+// 書籍では tcp_segment_arrives()
+func (stack *Stack) tcpSegmentArrives(seg *tcpSegmentInfo, flags uint8, data []uint8, local IPEndpoint, foreign IPEndpoint) {
+	pcb := stack.tcpPCBSelect(local, &foreign)
+	if pcb == nil || pcb.state == TCPPCBStateClosed {
+		if flags&TCPFlgRST > 0 {
+			return
+		}
+		if flags&TCPFlgACK == 0 {
+			stack.tcpOutputSegment(0, seg.seq+seg.len, TCPFlgRST|TCPFlgACK, 0, nil, local, foreign)
+		} else {
+			stack.tcpOutputSegment(seg.ack, 0, TCPFlgRST, 0, nil, local, foreign)
+		}
+		return
+	}
+
+	acceptable := false
+
+	switch pcb.state {
+	case TCPPCBStateListen:
+		// 1st check for an RST
+		if flags&TCPFlgRST > 0 {
+			return
+		}
+
+		// 2nd check for an ACK
+		if flags&TCPFlgACK > 0 {
+			stack.tcpOutputSegment(seg.ack, 0, TCPFlgRST, 0, nil, local, foreign)
+			return
+		}
+
+		// 3rd check for an SYN
+		if flags&TCPFlgSYN > 0 {
+			// ignore: security/compartment check
+			// ignore: precedence check
+
+			// NOTE: SYN が集中した場合に PCB を使い切らないように、接続を確立中の子の PCB も数える
+			if pcb.nbacklog <= stack.tcpPCBChildCount(pcb) {
+				logTCP.Errorf("backlog is full, local=%s", pcb.local.String())
+				return
+			}
+
+			// リスナーはそのままにして、接続用の PCB を新たに作成する
+			child := stack.tcpPCBAlloc()
+			if child == nil {
+				logTCP.Errorf("tcpPCBAlloc() failure")
+				return
+			}
+			child.parent = pcb
+			pcb = child
+
+			pcb.local = local
+			pcb.foreign = foreign
+			pcb.updateRcvWnd()
+			pcb.rcv.nxt = seg.seq + 1
+			pcb.irs = seg.seq
+			pcb.iss = rand.Uint32()
+			stack.tcpOutput(pcb, TCPFlgSYN|TCPFlgACK, nil)
+			pcb.snd.nxt = pcb.iss + 1
+			pcb.snd.una = pcb.iss
+			pcb.state = TCPPCBStateSynReceived
+			// ignore: Note that any other incoming control or data (combined with SYN)
+			//         will be processed in the SYN-RECEIVED state,
+			//         but processing of SYN and ACK should not be repeated
+			return
+		}
+
+		// 4th other text or control
+		// drop segment
+		return
+
+	case TCPPCBStateSynSent:
+		// 1st check the ACK bit
+		if flags&TCPFlgACK > 0 {
+			if tcpSeqLE(seg.ack, pcb.iss) || tcpSeqLT(pcb.snd.nxt, seg.ack) {
+				if flags&TCPFlgRST == 0 {
+					stack.tcpOutputSegment(seg.ack, 0, TCPFlgRST, 0, nil, local, foreign)
+				}
+				return
+			}
+			if tcpSeqLE(pcb.snd.una, seg.ack) && tcpSeqLE(seg.ack, pcb.snd.nxt) {
+				acceptable = true
+			}
+		}
+
+		// 2nd check the RST bit
+		if flags&TCPFlgRST > 0 {
+			if acceptable {
+				logTCP.Errorf("connection reset, local=%s, foreign=%s", local.String(), foreign.String())
+				pcb.state = TCPPCBStateClosed
+				pcb.err = ErrConnRefused
+				stack.tcpPCBRelease(pcb)
+			}
+			// drop segment
+			return
+		}
+
+		// 3rd check security and precedence (ignore)
+
+		// 4th check the SYN bit
+		if flags&TCPFlgSYN > 0 {
+			pcb.rcv.nxt = seg.seq + 1
+			pcb.irs = seg.seq
+			if acceptable {
+				pcb.snd.una = seg.ack
+				pcb.queueCleanup()
+			}
+			if tcpSeqLT(pcb.iss, pcb.snd.una) {
+				pcb.state = TCPPCBStateEstablished
+				stack.tcpOutput(pcb, TCPFlgACK, nil)
+				// NOTE: not specified in the RFC793, but send window initialization required
+				pcb.snd.wnd = seg.wnd
+				pcb.snd.wl1 = seg.seq
+				pcb.snd.wl2 = seg.ack
+				pcb.ctx.wakeup()
+				// ignore: continue processing at the sixth step below where the URG bit is checked
+				return
+			} else {
+				pcb.state = TCPPCBStateSynReceived
+				stack.tcpOutput(pcb, TCPFlgSYN|TCPFlgACK, nil)
+				// ignore: If there are other controls or text in the segment,
+				//         queue them for processing after the ESTABLISHED state has been reached
+				return
+			}
+		}
+
+		// 5th, if neither of the SYN or RST bits is set then drop the segment and return
+		return
+	}
+
+	// Otherwise
+
+	// 1st check sequence number
+	switch pcb.state {
+	case TCPPCBStateSynReceived, TCPPCBStateEstablished, TCPPCBStateFinWait1, TCPPCBStateFinWait2,
+		TCPPCBStateCloseWait, TCPPCBStateClosing, TCPPCBStateLastAck, TCPPCBStateTimeWait:
+		rcvEnd := pcb.rcv.nxt + uint32(pcb.rcv.wnd)
+		if seg.len == 0 {
+			if pcb.rcv.wnd == 0 {
+				acceptable = seg.seq == pcb.rcv.nxt
+			} else {
+				acceptable = tcpSeqLE(pcb.rcv.nxt, seg.seq) && tcpSeqLT(seg.seq, rcvEnd)
+			}
+		} else {
+			if pcb.rcv.wnd != 0 {
+				segEnd := seg.seq + seg.len - 1
+				acceptable = (tcpSeqLE(pcb.rcv.nxt, seg.seq) && tcpSeqLT(seg.seq, rcvEnd)) ||
+					(tcpSeqLE(pcb.rcv.nxt, segEnd) && tcpSeqLT(segEnd, rcvEnd))
+			}
+		}
+		if !acceptable {
+			if flags&TCPFlgRST == 0 {
+				stack.tcpOutput(pcb, TCPFlgACK, nil)
+			}
+			return
+		}
+	}
+
+	// 受信済みの部分を取り除いて、RCV.NXT から始まるセグメントとして扱う
+	if tcpSeqLT(seg.seq, pcb.rcv.nxt) {
+		skip := min(int(pcb.rcv.nxt-seg.seq), len(data))
+		data = data[skip:]
+		seg.seq += uint32(skip)
+	}
+
+	// 2nd check the RST bit
+	switch pcb.state {
+	case TCPPCBStateSynReceived, TCPPCBStateEstablished, TCPPCBStateFinWait1, TCPPCBStateFinWait2, TCPPCBStateCloseWait,
+		TCPPCBStateClosing, TCPPCBStateLastAck, TCPPCBStateTimeWait:
+		if flags&TCPFlgRST > 0 {
+			if pcb.state != TCPPCBStateSynReceived {
+				logTCP.Errorf("connection reset, local=%s, foreign=%s", local.String(), foreign.String())
+			}
+			pcb.state = TCPPCBStateClosed
+			pcb.err = ErrConnReset
+			stack.tcpPCBRelease(pcb)
+			return
+		}
+	}
+
+	// 3rd check security and precedence (ignore)
+
+	// 4th check the SYN bit
+	if flags&TCPFlgSYN > 0 {
+		stack.tcpOutput(pcb, TCPFlgRST, nil)
+		logTCP.Errorf("connection reset, local=%s, foreign=%s", local.String(), foreign.String())
+		pcb.state = TCPPCBStateClosed
+		pcb.err = ErrConnReset
+		stack.tcpPCBRelease(pcb)
+		return
+	}
+
+	// 5th check the ACK field
+	if flags&TCPFlgACK == 0 {
+		// drop segment
+		return
+	}
+	switch pcb.state {
+	case TCPPCBStateSynReceived:
+		if tcpSeqLT(pcb.snd.una, seg.ack) && tcpSeqLE(seg.ack, pcb.snd.nxt) {
+			pcb.state = TCPPCBStateEstablished
+			pcb.snd.wnd = seg.wnd
+			pcb.snd.wl1 = seg.seq
+			pcb.snd.wl2 = seg.ack
+			pcb.ctx.wakeup()
+			if pcb.parent != nil {
+				pcb.parent.backlog = append(pcb.parent.backlog, pcb)
+				pcb.parent.ctx.wakeup()
+			}
+		} else {
+			stack.tcpOutputSegment(seg.ack, 0, TCPFlgRST, 0, nil, local, foreign)
+			return
+		}
+		fallthrough
+
+	case TCPPCBStateEstablished, TCPPCBStateFinWait1, TCPPCBStateFinWait2, TCPPCBStateCloseWait, TCPPCBStateClosing:
+		if tcpSeqLE(pcb.snd.una, seg.ack) && tcpSeqLE(seg.ack, pcb.snd.nxt) {
+			if tcpSeqLT(pcb.snd.una, seg.ack) {
+				pcb.snd.una = seg.ack
+				pcb.queueCleanup()
+				// ignore: Users should receive positive acknowledgments for buffers
+				//         which have been SENT and fully acknowledged (i.e., SEND buffer should be returned with "ok" response)
+			}
+			if tcpSeqLT(pcb.snd.wl1, seg.seq) || (pcb.snd.wl1 == seg.seq && tcpSeqLE(pcb.snd.wl2, seg.ack)) {
+				pcb.snd.wnd = seg.wnd
+				pcb.snd.wl1 = seg.seq
+				pcb.snd.wl2 = seg.ack
+			}
+			// 送信ウィンドウが空くのを待っているタスクを起床させる
+			pcb.ctx.wakeup()
+		} else if tcpSeqLT(pcb.snd.nxt, seg.ack) {
+			// 未送信のデータに対する確認応答
+			stack.tcpOutput(pcb, TCPFlgACK, nil)
+			return
+		}
+		// 重複した確認応答（seg.ack < snd.una）は無視する
+
+		switch pcb.state {
+		case TCPPCBStateFinWait1:
+			if seg.ack == pcb.snd.nxt {
+				// 送信した FIN が確認された
+				pcb.state = TCPPCBStateFinWait2
+			}
+		case TCPPCBStateFinWait2:
+			// do not delete the TCB
+		case TCPPCBStateCloseWait:
+			// do nothing
+		case TCPPCBStateClosing:
+			if seg.ack == pcb.snd.nxt {
+				pcb.enterTimewait()
+			}
+		}
+
+	case TCPPCBStateLastAck:
+		if seg.ack == pcb.snd.nxt {
+			pcb.state = TCPPCBStateClosed
+			stack.tcpPCBRelease(pcb)
+		}
+		return
+
+	case TCPPCBStateTimeWait:
+		if flags&TCPFlgFIN > 0 {
+			// FIN の再送を受信したためタイマーを再始動する
+			pcb.twTimer = time.Now().Add(TCPTimewaitTimeout)
+		}
+	}
+
+	// 6th, check the URG bit (ignore)
+
+	// 7th, process the segment text
+	// NOTE: 順序通りに到着したデータのみを受信する（順序が入れ替わったデータは破棄して再送を待つ）
+	inOrder := seg.seq == pcb.rcv.nxt
+	accepted := 0
+	switch pcb.state {
+	case TCPPCBStateEstablished, TCPPCBStateFinWait1, TCPPCBStateFinWait2:
+		if len(data) > 0 {
+			if inOrder {
+				accepted = min(len(data), int(pcb.rcv.wnd))
+				pcb.buf = append(pcb.buf, data[:accepted]...)
+				pcb.rcv.nxt += uint32(accepted)
+				pcb.updateRcvWnd()
+				pcb.ctx.wakeup()
+			}
+			stack.tcpOutput(pcb, TCPFlgACK, nil)
+		}
+	case TCPPCBStateCloseWait, TCPPCBStateClosing, TCPPCBStateLastAck, TCPPCBStateTimeWait:
+		// ignore segment text
+	}
+
+	// 8th, check the FIN bit
+	// NOTE: FIN の手前までのデータをすべて受信した場合のみ FIN を受け付ける
+	if flags&TCPFlgFIN > 0 && inOrder && accepted == len(data) {
+		switch pcb.state {
+		case TCPPCBStateClosed, TCPPCBStateListen, TCPPCBStateSynSent:
+			// drop segment
+			return
+		}
+
+		pcb.rcv.nxt++
+		stack.tcpOutput(pcb, TCPFlgACK, nil)
+
+		switch pcb.state {
+		case TCPPCBStateSynReceived, TCPPCBStateEstablished:
+			pcb.state = TCPPCBStateCloseWait
+			pcb.ctx.wakeup()
+		case TCPPCBStateFinWait1:
+			// 送信した FIN がまだ確認されていない（同時クローズ）
+			pcb.state = TCPPCBStateClosing
+		case TCPPCBStateFinWait2:
+			pcb.enterTimewait()
+		case TCPPCBStateCloseWait:
+			// Remain in the CLOSE-WAIT state
+		case TCPPCBStateClosing:
+			// Remain in the CLOSING state
+		case TCPPCBStateLastAck:
+			// Remain in the LAST-ACK state
+		case TCPPCBStateTimeWait:
+			// Remain in the TIME-WAIT state
+			pcb.twTimer = time.Now().Add(TCPTimewaitTimeout)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+// ユーザーコマンド
+// ----------------------------------------------------------------------------
+
+// 書籍では tcp_open()
+func (stack *Stack) TCPOpen() (int, error) {
+	stack.tcp.mutex.Lock()
+	defer stack.tcp.mutex.Unlock()
+
+	pcb := stack.tcpPCBAlloc()
+	if pcb == nil {
+		logTCP.Errorf("tcpPCBAlloc() failure")
+		return -1, fmt.Errorf("%w: tcp pcb", ErrNoResource)
+	}
+
+	return stack.tcpPCBID(pcb), nil
+}
+
+// 書籍では tcp_bind()
+func (stack *Stack) TCPBind(id int, local IPEndpoint) error {
+	stack.tcp.mutex.Lock()
+	defer stack.tcp.mutex.Unlock()
+
+	pcb := stack.tcpPCBGet(id)
+	if pcb == nil {
+		logTCP.Errorf("pcb not found, id=%d", id)
+		return fmt.Errorf("%w, id=%d", ErrBadDescriptor, id)
+	}
+	if pcb.state != TCPPCBStateClosed {
+		logTCP.Errorf("invalid state, id=%d, state=%s", id, pcb.state.String())
+		return fmt.Errorf("%w, id=%d, state=%s", ErrInvalidState, id, pcb.state.String())
+	}
+
+	exist := stack.tcpPCBSelect(local, nil)
+	if exist != nil {
+		logTCP.Errorf("already in use, id=%d, want=%s, exist=%s", id, local.String(), exist.local.String())
+		return fmt.Errorf("%w, local=%s", ErrAddrInUse, local.String())
+	}
+
+	pcb.local = local
+	logTCP.Debugf("bound, id=%d, local=%s", id, pcb.local.String())
+	return nil
+}
+
+// パッシブオープン
+// 書籍では tcp_listen()
+func (stack *Stack) TCPListen(id int, backlog int) error {
+	stack.tcp.mutex.Lock()
+	defer stack.tcp.mutex.Unlock()
+
+	pcb := stack.tcpPCBGet(id)
+	if pcb == nil {
+		logTCP.Errorf("pcb not found, id=%d", id)
+		return fmt.Errorf("%w, id=%d", ErrBadDescriptor, id)
+	}
+	if pcb.state != TCPPCBStateClosed {
+		logTCP.Errorf("invalid state, id=%d, state=%s", id, pcb.state.String())
+		return fmt.Errorf("%w, id=%d, state=%s", ErrInvalidState, id, pcb.state.String())
+	}
+
+	pcb.state = TCPPCBStateListen
+	pcb.nbacklog = max(backlog, 1)
+
+	logTCP.Debugf("listen, id=%d, local=%s, backlog=%d", id, pcb.local.String(), pcb.nbacklog)
+	return nil
+}
+
+// NOTE: 接続が確立するか、中断されるまでブロックする
+// 書籍では tcp_accept()
+func (stack *Stack) TCPAccept(id int) (int, IPEndpoint, error) {
+	stack.tcp.mutex.Lock()
+	defer stack.tcp.mutex.Unlock()
+
+	pcb := stack.tcpPCBGet(id)
+	if pcb == nil {
+		logTCP.Errorf("pcb not found, id=%d", id)
+		return -1, IPEndpoint{}, fmt.Errorf("%w, id=%d", ErrBadDescriptor, id)
+	}
+	if pcb.state != TCPPCBStateListen {
+		logTCP.Errorf("not in LISTEN state, id=%d, state=%s", id, pcb.state.String())
+		return -1, IPEndpoint{}, fmt.Errorf("%w, id=%d, state=%s", ErrInvalidState, id, pcb.state.String())
+	}
+
+	var child *tcpPCB
+	for child == nil {
+		for len(pcb.backlog) == 0 {
+			ok := pcb.ctx.sleep(time.Time{})
+			if pcb.state == TCPPCBStateClosed {
+				logTCP.Debugf("closed, id=%d", id)
+				err := pcb.closedErr(id)
+				stack.tcpPCBRelease(pcb)
+				return -1, IPEndpoint{}, err
+			}
+			if !ok {
+				logTCP.Debugf("interrupted, id=%d", id)
+				return -1, IPEndpoint{}, fmt.Errorf("%w, id=%d", ErrInterrupted, id)
+			}
+		}
+
+		child = pcb.backlog[0]
+		pcb.backlog = pcb.backlog[1:]
+		// NOTE: 解放されて別の接続に再利用された PCB を返さないように、状態とリスナーを確認する
+		if child.parent != pcb || (child.state != TCPPCBStateEstablished && child.state != TCPPCBStateCloseWait) {
+			logTCP.Debugf("skip released child, id=%d", stack.tcpPCBID(child))
+			child = nil
+		}
+	}
+	child.parent = nil
+
+	logTCP.Debugf("accepted, id=%d, local=%s, foreign=%s", stack.tcpPCBID(child), child.local.String(), child.foreign.String())
+	return stack.tcpPCBID(child), child.foreign, nil
+}
+
+// アクティブオープン
+// NOTE: 接続が確立するか、中断されるまでブロックする
+// 書籍では tcp_connect()
+func (stack *Stack) TCPConnect(id int, foreign IPEndpoint) error {
+	stack.tcp.mutex.Lock()
+	defer stack.tcp.mutex.Unlock()
+
+	pcb := stack.tcpPCBGet(id)
+	if pcb == nil {
+		logTCP.Errorf("pcb not found, id=%d", id)
+		return fmt.Errorf("%w, id=%d", ErrBadDescriptor, id)
+	}
+	if pcb.state != TCPPCBStateClosed {
+		logTCP.Errorf("invalid state, id=%d, state=%s", id, pcb.state.String())
+		return fmt.Errorf("%w, id=%d, state=%s", ErrInvalidState, id, pcb.state.String())
+	}
+
+	local := pcb.local
+	if local.Addr == IPAddrAny {
+		iface := stack.IPRouteGetIface(foreign.Addr)
+		if iface == nil {
+			logTCP.Errorf("iface not found that can reach foreign address, addr=%s", foreign.Addr.String())
+			return fmt.Errorf("%w, dst=%s", ErrNoRoute, foreign.Addr.String())
+		}
+		local.Addr = iface.unicast
+		logTCP.Debugf("select local address, addr=%s", local.Addr.String())
+	}
+	if local.Port == 0 {
+		// 未使用のエフェメラルポートを割り当てる
+		for port := TCPSourcePortMin; port <= TCPSourcePortMax; port++ {
+			local.Port = uint16(port)
+			if stack.tcpPCBSelect(local, &foreign) == nil {
+				logTCP.Debugf("dynamic assign local port, port=%d", port)
+				break
+			}
+			local.Port = 0
+		}
+		if local.Port == 0 {
+			logTCP.Errorf("failed to dynamic assign local port, addr=%s", local.Addr.String())
+			return fmt.Errorf("%w: ephemeral port, addr=%s", ErrNoResource, local.Addr.String())
+		}
+	}
+
+	pcb.local = local
+	pcb.foreign = foreign
+	pcb.updateRcvWnd()
+	pcb.iss = rand.Uint32()
+	if _, err := stack.tcpOutput(pcb, TCPFlgSYN, nil); err != nil {
+		logTCP.Errorf("tcpOutput() failure")
+		pcb.state = TCPPCBStateClosed
+		stack.tcpPCBRelease(pcb)
+		return err
+	}
+	pcb.snd.una = pcb.iss
+	pcb.snd.nxt = pcb.iss + 1
+	pcb.state = TCPPCBStateSynSent
+
+	for {
+		state := pcb.state
+		for pcb.state == state {
+			ok := pcb.ctx.sleep(time.Time{})
+			if pcb.state == TCPPCBStateClosed {
+				break
+			}
+			if !ok {
+				logTCP.Debugf("interrupted, id=%d", id)
+				pcb.state = TCPPCBStateClosed
+				stack.tcpPCBRelease(pcb)
+				return fmt.Errorf("%w, id=%d", ErrInterrupted, id)
+			}
+		}
+		if pcb.state == TCPPCBStateSynReceived {
+			// 同時オープンの場合は接続の確立を待つ
+			continue
+		}
+		break
+	}
+
+	if pcb.state != TCPPCBStateEstablished {
+		logTCP.Errorf("open error, id=%d, state=%s", id, pcb.state.String())
+		pcb.state = TCPPCBStateClosed
+		err := pcb.closedErr(id)
+		stack.tcpPCBRelease(pcb)
+		return err
+	}
+
+	logTCP.Debugf("connection established, id=%d, local=%s, foreign=%s", id, pcb.local.String(), pcb.foreign.String())
+	return nil
+}
+
+// NOTE: 送信ウィンドウが空くまでブロックする
+// NOTE: すべて送信する前に失敗した場合は、送信済みのバイト数とエラーを返す
+// 書籍では tcp_send()
+func (stack *Stack) TCPSend(id int, data []uint8) (int, error) {
+	stack.tcp.mutex.Lock()
+	defer stack.tcp.mutex.Unlock()
+
+	pcb := stack.tcpPCBGet(id)
+	if pcb == nil {
+		logTCP.Errorf("pcb not found, id=%d", id)
+		return 0, fmt.Errorf("%w, id=%d", ErrBadDescriptor, id)
+	}
+
+	sent := 0
+	for sent < len(data) {
+		switch pcb.state {
+		case TCPPCBStateEstablished, TCPPCBStateCloseWait:
+			// 送信可能
+		case TCPPCBStateClosed:
+			logTCP.Errorf("connection closed, id=%d", id)
+			err := pcb.closedErr(id)
+			stack.tcpPCBRelease(pcb)
+			return sent, err
+		default:
+			logTCP.Errorf("invalid state, id=%d, state=%s", id, pcb.state.String())
+			return sent, fmt.Errorf("%w, id=%d, state=%s", ErrInvalidState, id, pcb.state.String())
+		}
+
+		iface := stack.IPRouteGetIface(pcb.foreign.Addr)
+		if iface == nil {
+			logTCP.Errorf("iface not found, foreign=%s", pcb.foreign.Addr.String())
+			return sent, fmt.Errorf("%w, dst=%s", ErrNoRoute, pcb.foreign.Addr.String())
+		}
+		mss := iface.Info().Dev.Info().MTU - (IPHdrSizeMin + TCPHdrSizeMin)
+
+		capacity := int(pcb.snd.wnd) - int(pcb.snd.nxt-pcb.snd.una)
+		if capacity <= 0 {
+			if !pcb.ctx.sleep(time.Time{}) {
+				logTCP.Debugf("interrupted, id=%d", id)
+				return sent, fmt.Errorf("%w, id=%d", ErrInterrupted, id)
+			}
+			continue
+		}
+
+		slen := min(mss, len(data)-sent, capacity)
+		if _, err := stack.tcpOutput(pcb, TCPFlgACK|TCPFlgPSH, data[sent:sent+slen]); err != nil {
+			logTCP.Errorf("tcpOutput() failure")
+			pcb.state = TCPPCBStateClosed
+			stack.tcpPCBRelease(pcb)
+			return sent, err
+		}
+		pcb.snd.nxt += uint32(slen)
+		sent += slen
+	}
+
+	return sent, nil
+}
+
+// NOTE: データを受信するか、中断されるまでブロックする
+// NOTE: 相手が接続を閉じてデータが残っていない場合は 0 を返す
+// 書籍では tcp_receive()
+func (stack *Stack) TCPReceive(id int, buf []uint8) (int, error) {
+	stack.tcp.mutex.Lock()
+	defer stack.tcp.mutex.Unlock()
+
+	pcb := stack.tcpPCBGet(id)
+	if pcb == nil {
+		logTCP.Errorf("pcb not found, id=%d", id)
+		return 0, fmt.Errorf("%w, id=%d", ErrBadDescriptor, id)
+	}
+
+	for len(pcb.buf) == 0 {
+		switch pcb.state {
+		case TCPPCBStateEstablished:
+			// 受信を待つ
+		case TCPPCBStateCloseWait:
+			// 相手が接続を閉じたため、これ以上データは届かない
+			return 0, nil
+		case TCPPCBStateClosed:
+			logTCP.Errorf("connection closed, id=%d", id)
+			err := pcb.closedErr(id)
+			stack.tcpPCBRelease(pcb)
+			return 0, err
+		default:
+			logTCP.Errorf("invalid state, id=%d, state=%s", id, pcb.state.String())
+			return 0, fmt.Errorf("%w, id=%d, state=%s", ErrInvalidState, id, pcb.state.String())
+		}
+
+		if !pcb.ctx.sleep(time.Time{}) {
+			logTCP.Debugf("interrupted, id=%d", id)
+			return 0, fmt.Errorf("%w, id=%d", ErrInterrupted, id)
+		}
+	}
+
+	wasZero := pcb.rcv.wnd == 0
+	n := copy(buf, pcb.buf)
+	pcb.buf = pcb.buf[n:]
+	pcb.updateRcvWnd()
+
+	if wasZero {
+		// 受信ウィンドウが開いたことを通知する
+		stack.tcpOutput(pcb, TCPFlgACK, nil)
+	}
+
+	return n, nil
+}
+
+// 書籍では tcp_close()
+func (stack *Stack) TCPClose(id int) error {
+	stack.tcp.mutex.Lock()
+	defer stack.tcp.mutex.Unlock()
+
+	pcb := stack.tcpPCBGet(id)
+	if pcb == nil {
+		logTCP.Errorf("pcb not found, id=%d", id)
+		return fmt.Errorf("%w, id=%d", ErrBadDescriptor, id)
+	}
+
+	switch pcb.state {
+	case TCPPCBStateClosed, TCPPCBStateListen, TCPPCBStateSynSent:
+		pcb.state = TCPPCBStateClosed
+	case TCPPCBStateSynReceived, TCPPCBStateEstablished:
+		stack.tcpOutput(pcb, TCPFlgACK|TCPFlgFIN, nil)
+		pcb.snd.nxt++
+		pcb.state = TCPPCBStateFinWait1
+	case TCPPCBStateCloseWait:
+		stack.tcpOutput(pcb, TCPFlgACK|TCPFlgFIN, nil)
+		pcb.snd.nxt++
+		pcb.state = TCPPCBStateLastAck
+	default:
+		logTCP.Errorf("connection closing, id=%d, state=%s", id, pcb.state.String())
+		return fmt.Errorf("%w, id=%d, state=%s", ErrInvalidState, id, pcb.state.String())
+	}
+	pcb.detached = true
+
+	if pcb.state == TCPPCBStateClosed {
+		stack.tcpPCBRelease(pcb)
+	} else {
+		pcb.ctx.wakeup()
+	}
+	return nil
+}
+
+// ブロックしているユーザーコマンドを中断させる
+// 書籍では tcp_event_handler()
+func (stack *Stack) tcpEventHandler(arg any) {
+	stack.tcp.mutex.Lock()
+	defer stack.tcp.mutex.Unlock()
+
+	for i := range stack.tcp.pcbs {
+		pcb := &stack.tcp.pcbs[i]
+		if pcb.state != TCPPCBStateFree {
+			pcb.ctx.interrupt()
+		}
+	}
+}
+
+func (stack *Stack) TCPInit() error {
+	if err := stack.IPUpperProtocolRegister(&TCPProtocol{
+		IPUpperProtocolInfo{
+			Protocol: IPUpperProtocolTypeTCP,
+		},
+	}); err != nil {
+		logTCP.Errorf("IPUpperProtocolRegister() failure")
+		return err
+	}
+
+	if err := stack.NetEventSubscribe(stack.tcpEventHandler, nil); err != nil {
+		logTCP.Errorf("NetEventSubscribe() failure")
+		return err
+	}
+
+	// NOTE: セグメントごとにタイマーを用意せず、１つのタイマーで全ての PCB の再送を処理する
+	if err := stack.NetTimerRegister("TCP Timer", TCPTimerInterval, stack.tcpTimerHandler); err != nil {
+		logTCP.Errorf("NetTimerRegister() failure")
+		return err
+	}
+
+	return nil
+}
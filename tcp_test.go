@@ -0,0 +1,89 @@
+package microps
+
+import (
+	"testing"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+// NOTE: 以前の実装（toBytes()）は ip_test.go に定義している
+
+var benchTCPHdr = TCPHdr{
+	Src: util.Hton16(7),
+	Dst: util.Hton16(10007),
+	Seq: util.Hton32(1),
+	Ack: util.Hton32(1),
+	Off: (TCPHdrSizeMin >> 2) << 4,
+	Wnd: util.Hton16(65535),
+}
+
+func BenchmarkTCPHdrMarshal(b *testing.B) {
+	b.ReportAllocs()
+	buf := make([]uint8, TCPHdrSizeMin)
+	for b.Loop() {
+		benchTCPHdr.Marshal(buf)
+	}
+}
+
+func BenchmarkTCPHdrMarshalBinary(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		toBytes(benchTCPHdr)
+	}
+}
+
+func TestTCPHdrMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  TCPHdr
+		wire []uint8
+	}{
+		{
+			name: "SYN+ACK",
+			hdr: TCPHdr{
+				Src: util.Hton16(7),
+				Dst: util.Hton16(10007),
+				Seq: util.Hton32(0x00000001),
+				Ack: util.Hton32(0x00000002),
+				Off: (TCPHdrSizeMin >> 2) << 4,
+				Flg: TCPFlgSYN | TCPFlgACK,
+				Wnd: util.Hton16(65535),
+				Sum: util.Hton16(0x1234),
+			},
+			wire: []uint8{
+				0x00, 0x07, 0x27, 0x17,
+				0x00, 0x00, 0x00, 0x01,
+				0x00, 0x00, 0x00, 0x02,
+				0x50, 0x12, 0xff, 0xff,
+				0x12, 0x34, 0x00, 0x00,
+			},
+		},
+		{
+			name: "FIN+ACK, urgent pointer",
+			hdr: TCPHdr{
+				Src: util.Hton16(49152),
+				Dst: util.Hton16(80),
+				Seq: util.Hton32(0xfedcba98),
+				Ack: util.Hton32(0x01234567),
+				Off: (TCPHdrSizeMin >> 2) << 4,
+				Flg: TCPFlgFIN | TCPFlgACK | TCPFlgURG,
+				Wnd: util.Hton16(0x0200),
+				Sum: util.Hton16(0xabcd),
+				Up:  util.Hton16(0x0010),
+			},
+			wire: []uint8{
+				0xc0, 0x00, 0x00, 0x50,
+				0xfe, 0xdc, 0xba, 0x98,
+				0x01, 0x23, 0x45, 0x67,
+				0x50, 0x31, 0x02, 0x00,
+				0xab, 0xcd, 0x00, 0x10,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHdrRoundTrip(t, &tt.hdr, &TCPHdr{}, tt.wire)
+		})
+	}
+}
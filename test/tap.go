@@ -29,6 +29,10 @@ type ifreq struct {
 }
 
 func main() {
+	// 環境変数 HEXDUMP が指定された場合は16進ダンプを出力する
+	if os.Getenv("HEXDUMP") != "" {
+		microps.SetDump(true)
+	}
 
 	if len(os.Args) != 2 {
 		fmt.Fprintf(os.Stderr, "usage: %s <ifname>\n", os.Args[0])
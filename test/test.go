@@ -4,10 +4,9 @@ package main
 
 import (
 	"context"
-	"math"
+	"errors"
 	"os"
 	"os/signal"
-	"time"
 
 	"github.com/bugph0bia/go-microps"
 	"github.com/bugph0bia/go-microps/internal/util"
@@ -25,26 +24,22 @@ const etherTAPNetmask = "255.255.255.0"
 
 const defaultGateway = "192.0.2.1"
 
-var testData = []uint8{
-	0x45, 0x00, 0x00, 0x30,
-	0x00, 0x80, 0x00, 0x00,
-	0xff, 0x01, 0xbd, 0x4a,
-	0x7f, 0x00, 0x00, 0x01,
-	0x7f, 0x00, 0x00, 0x01,
-	0x08, 0x00, 0x35, 0x64,
-	0x00, 0x80, 0x00, 0x01,
-	0x31, 0x32, 0x33, 0x34,
-	0x35, 0x36, 0x37, 0x38,
-	0x39, 0x30, 0x21, 0x40,
-	0x23, 0x24, 0x25, 0x5e,
-	0x26, 0x2a, 0x28, 0x29,
-}
+// エコーサーバーの待ち受けアドレス
+const echoServerEndpoint = "0.0.0.0:7"
 
-var terminate bool = false
+// プロトコルスタック
+var stack *microps.Stack
 
 func main() {
 	ret := true
 
+	stack = microps.New(microps.Options{})
+
+	// 環境変数 HEXDUMP が指定された場合は16進ダンプを出力する
+	if os.Getenv("HEXDUMP") != "" {
+		microps.SetDump(true)
+	}
+
 	// シグナルによる割り込み処理
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
@@ -52,7 +47,8 @@ func main() {
 	// onSignal
 	go func() {
 		<-ctx.Done()
-		terminate = true
+		// ブロックしているユーザーコマンドを中断させる
+		stack.NetRaiseEvent()
 	}()
 
 	if !setup() {
@@ -77,29 +73,58 @@ func main() {
 func setup() bool {
 	util.Infof("setup protocol stack...")
 
-	if !microps.NetInit() {
-		util.Errorf("netInit() failure")
+	if err := stack.NetInit(); err != nil {
+		util.Errorf("netInit() failure: %s", err.Error())
 		return false
 	}
 
-	dev := microps.LoopbackInit()
-	if dev == nil {
-		util.Errorf("LoopbackInit() falure")
+	dev, err := stack.LoopbackInit()
+	if err != nil {
+		util.Errorf("LoopbackInit() falure: %s", err.Error())
 		return false
 	}
 
-	iface := microps.IPIfaceAlloc(loopbackIPAddr, loopbackNetmask)
-	if iface == nil {
-		util.Errorf("IPIfaceAlloc() failure")
+	iface, err := microps.IPIfaceAlloc(loopbackIPAddr, loopbackNetmask)
+	if err != nil {
+		util.Errorf("IPIfaceAlloc() failure: %s", err.Error())
 		return false
 	}
-	if !microps.IPIfaceRegister(dev, iface) {
-		util.Errorf("IPIfaceRegister() failure")
+	if err := stack.IPIfaceRegister(dev, iface); err != nil {
+		util.Errorf("IPIfaceRegister() failure: %s", err.Error())
 		return false
 	}
 
-	if !microps.NetRun() {
-		util.Errorf("netRun() failure")
+	dev, err = stack.EtherTapInit(etherTAPName, etherTAPHWAddr)
+	if err != nil {
+		util.Errorf("EtherTapInit() failure: %s", err.Error())
+		return false
+	}
+
+	// 環境変数 CAPTURE が指定された場合は TAP デバイスの通信を pcapng ファイルに書き出す
+	if name := os.Getenv("CAPTURE"); name != "" {
+		if err := stack.CaptureStartFile(dev, name, microps.CaptureFormatPcapng); err != nil {
+			util.Errorf("CaptureStartFile() failure: %s", err.Error())
+			return false
+		}
+	}
+
+	iface, err = microps.IPIfaceAlloc(etherTAPIPAddr, etherTAPNetmask)
+	if err != nil {
+		util.Errorf("IPIfaceAlloc() failure: %s", err.Error())
+		return false
+	}
+	if err := stack.IPIfaceRegister(dev, iface); err != nil {
+		util.Errorf("IPIfaceRegister() failure: %s", err.Error())
+		return false
+	}
+
+	if err := stack.IPRouteSetDefaultGateway(iface, defaultGateway); err != nil {
+		util.Errorf("IPRouteSetDefaultGateway() failure: %s", err.Error())
+		return false
+	}
+
+	if err := stack.NetRun(); err != nil {
+		util.Errorf("netRun() failure: %s", err.Error())
 		return false
 	}
 
@@ -107,22 +132,49 @@ func setup() bool {
 }
 
 func appMain() bool {
-	src, _ := microps.ParseIPAddr(loopbackIPAddr)
-	dst := src
-	var id uint32 = uint32(os.Getpid() % math.MaxUint16)
-	var seq uint32 = 0
-	data := []uint8("TEST")
+	local, ok := microps.ParseIPEndpoint(echoServerEndpoint)
+	if !ok {
+		util.Errorf("ParseIPEndpoint() failure")
+		return false
+	}
+
+	soc, err := stack.UDPOpen()
+	if err != nil {
+		util.Errorf("UDPOpen() failure: %s", err.Error())
+		return false
+	}
+	defer stack.UDPClose(soc)
 
+	if err := stack.UDPBind(soc, local); err != nil {
+		util.Errorf("UDPBind() failure: %s", err.Error())
+		return false
+	}
+
+	util.Debugf("waiting for data...")
 	util.Debugf("press Ctrl+C to terminate")
 
-	for !terminate {
-		seq++
-		var val uint32 = util.Hton32(id<<16 | seq)
-		if ok := microps.ICMPOutput(microps.ICMPTypeEcho, 0, val, data, src, dst); !ok {
-			util.Errorf("ICMPOutput() failure")
+	buf := make([]uint8, 2048)
+	for {
+		n, foreign, err := stack.UDPRecvFrom(soc, buf)
+		if err != nil {
+			if errors.Is(err, microps.ErrInterrupted) {
+				// 中断された
+				break
+			}
+			util.Errorf("UDPRecvFrom() failure: %s", err.Error())
+			return false
+		}
+		util.Debugf("%d bytes data from %s", n, foreign.String())
+		util.DebugDump(buf[:n])
+
+		if _, err := stack.UDPSendTo(soc, buf[:n], foreign); err != nil {
+			if errors.Is(err, microps.ErrARPIncomplete) {
+				// アドレス解決中のため破棄された
+				continue
+			}
+			util.Errorf("UDPSendTo() failure: %s", err.Error())
 			return false
 		}
-		time.Sleep(1 * time.Second)
 	}
 
 	util.Debugf("terminate")
@@ -132,8 +184,8 @@ func appMain() bool {
 func cleanup() bool {
 	util.Infof("cleanup protocol stack...")
 
-	if !microps.NetShutdown() {
-		util.Errorf("NetShutdown() failure")
+	if err := stack.NetShutdown(); err != nil {
+		util.Errorf("NetShutdown() failure: %s", err.Error())
 		return false
 	}
 	return true
@@ -0,0 +1,518 @@
+package microps
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+const UDPHdrSize = 8
+const UDPPseudoHdrSize = 12
+
+const UDPPCBSize = 16
+
+// PCB ごとの受信キューの長さの上限（超えた場合は破棄する）
+const UDPPCBQueueSizeMax = 64
+
+// エフェメラルポートの範囲
+const (
+	UDPSourcePortMin = 49152
+	UDPSourcePortMax = 65535
+)
+
+// UDP PCB の状態
+type udpPCBState uint8
+
+const (
+	udpPCBStateFree udpPCBState = iota
+	udpPCBStateOpen
+	udpPCBStateClosing
+)
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// IPエンドポイント
+// NOTE: Port はホストバイトオーダーで保持する
+type IPEndpoint struct {
+	Addr IPAddr
+	Port uint16
+}
+
+func (ep IPEndpoint) String() string {
+	return fmt.Sprintf("%s:%d", ep.Addr.String(), ep.Port)
+}
+
+func ParseIPEndpoint(str string) (IPEndpoint, bool) {
+	addr, port, found := strings.Cut(str, ":")
+	if !found {
+		return IPEndpoint{}, false
+	}
+
+	ipAddr, ok := ParseIPAddr(addr)
+	if !ok {
+		return IPEndpoint{}, false
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return IPEndpoint{}, false
+	}
+
+	return IPEndpoint{Addr: ipAddr, Port: uint16(n)}, true
+}
+
+// UDP疑似ヘッダ
+type UDPPseudoHdr struct {
+	Src      IPAddr
+	Dst      IPAddr
+	Zero     uint8
+	Protocol uint8
+	Len      uint16
+}
+
+func (hdr *UDPPseudoHdr) Marshal(b []uint8) {
+	binary.NativeEndian.PutUint32(b[0:], uint32(hdr.Src))
+	binary.NativeEndian.PutUint32(b[4:], uint32(hdr.Dst))
+	b[8] = hdr.Zero
+	b[9] = hdr.Protocol
+	binary.NativeEndian.PutUint16(b[10:], hdr.Len)
+}
+
+// UDPヘッダ
+type UDPHdr struct {
+	Src uint16 // Source Port
+	Dst uint16 // Destination Port
+	Len uint16 // Length
+	Sum uint16 // Checksum
+}
+
+func (hdr *UDPHdr) Marshal(b []uint8) {
+	binary.NativeEndian.PutUint16(b[0:], hdr.Src)
+	binary.NativeEndian.PutUint16(b[2:], hdr.Dst)
+	binary.NativeEndian.PutUint16(b[4:], hdr.Len)
+	binary.NativeEndian.PutUint16(b[6:], hdr.Sum)
+}
+
+func (hdr *UDPHdr) Unmarshal(b []uint8) bool {
+	if len(b) < UDPHdrSize {
+		return false
+	}
+	hdr.Src = binary.NativeEndian.Uint16(b[0:])
+	hdr.Dst = binary.NativeEndian.Uint16(b[2:])
+	hdr.Len = binary.NativeEndian.Uint16(b[4:])
+	hdr.Sum = binary.NativeEndian.Uint16(b[6:])
+	return true
+}
+
+// UDP PCB の受信キューのエントリ
+type udpQueueEntry struct {
+	foreign IPEndpoint
+	data    []uint8
+}
+
+// UDP PCB (Protocol Control Block)
+type udpPCB struct {
+	state udpPCBState
+	local IPEndpoint
+	queue []udpQueueEntry
+	ctx   schedCtx
+}
+
+// UDPプロトコル
+type UDPProtocol struct {
+	IPUpperProtocolInfo
+}
+
+func (proto *UDPProtocol) Info() *IPUpperProtocolInfo {
+	return &proto.IPUpperProtocolInfo
+}
+
+// 書籍では udp_input()
+func (proto *UDPProtocol) InputHandler(ipHdr *IPHdr, data []uint8, packet []uint8, ipIface *IPIface) {
+	if len(data) < UDPHdrSize {
+		logUDP.Errorf("too short")
+		return
+	}
+
+	var hdr UDPHdr
+	if !hdr.Unmarshal(data) {
+		logUDP.Errorf("Unmarshal() failure")
+		return
+	}
+
+	if len(data) != int(util.Ntoh16(hdr.Len)) {
+		logUDP.Errorf("length error: len=%d, hdr.len=%d", len(data), util.Ntoh16(hdr.Len))
+		return
+	}
+
+	if hdr.Sum != 0 {
+		psum := udpPseudoCksum(ipHdr.Src, ipHdr.Dst, len(data))
+		if util.Cksum16(data, psum) != 0 {
+			logUDP.Errorf("checksum error")
+			return
+		}
+	}
+
+	logUDP.Debugf("%s:%d => %s:%d, len=%d (payload=%d)",
+		ipHdr.Src.String(), util.Ntoh16(hdr.Src), ipHdr.Dst.String(), util.Ntoh16(hdr.Dst), len(data), len(data)-UDPHdrSize)
+	udpPrint(data, proto.stack.dumpIPUpperProtocol(IPUpperProtocolTypeUDP))
+
+	local := IPEndpoint{Addr: ipHdr.Dst, Port: util.Ntoh16(hdr.Dst)}
+	foreign := IPEndpoint{Addr: ipHdr.Src, Port: util.Ntoh16(hdr.Src)}
+
+	stack := proto.stack
+
+	stack.udp.mutex.Lock()
+	pcb := stack.udpPCBSelect(local.Addr, local.Port)
+	if pcb != nil && UDPPCBQueueSizeMax <= len(pcb.queue) {
+		// 読み出されないまま溜まり続けないように破棄する
+		logUDP.Errorf("queue is full, id=%d, num=%d", stack.udpPCBID(pcb), len(pcb.queue))
+	} else if pcb != nil {
+		pcb.queue = append(pcb.queue, udpQueueEntry{
+			foreign: foreign,
+			data:    append([]uint8(nil), data[UDPHdrSize:]...),
+		})
+		logUDP.Debugf("queue pushed: id=%d, num=%d", stack.udpPCBID(pcb), len(pcb.queue))
+		pcb.ctx.wakeup()
+	}
+	stack.udp.mutex.Unlock()
+
+	if pcb == nil {
+		// ポートが使用されていないため ICMP Port Unreachable を返す
+		if ipHdr.Dst == ipIface.broadcast {
+			return
+		}
+		// NOTE: 元のデータグラムのIPヘッダ（オプションを含む）をそのまま含める
+		stack.ipSendICMPError(ICMPTypeDestUnreach, ICMPCodePortUnreach, 0, ipHdr, packet)
+	}
+}
+
+// UDPの状態
+type udpState struct {
+	pcbs  [UDPPCBSize]udpPCB
+	mutex sync.Mutex
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+// NOTE: 16進ダンプは全体のダンプ出力が有効な場合のみ出力する
+func UDPPrint(data []uint8) {
+	udpPrint(data, util.DumpEnabled())
+}
+
+func udpPrint(data []uint8, hex bool) {
+	if !logUDP.Enabled(slog.LevelDebug) && !hex {
+		return
+	}
+
+	var hdr UDPHdr
+	if !hdr.Unmarshal(data) {
+		logUDP.Errorf("Unmarshal() failure")
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "        src: %d\n", util.Ntoh16(hdr.Src))
+	fmt.Fprintf(&sb, "        dst: %d\n", util.Ntoh16(hdr.Dst))
+	fmt.Fprintf(&sb, "        len: %d\n", util.Ntoh16(hdr.Len))
+	fmt.Fprintf(&sb, "        sum: 0x%04x\n", util.Ntoh16(hdr.Sum))
+
+	logUDP.Dump(sb.String(), data, hex)
+}
+
+// 疑似ヘッダのチェックサムを計算して、チェックサムの初期値として返す
+func udpPseudoCksum(src IPAddr, dst IPAddr, length int) uint32 {
+	pseudo := UDPPseudoHdr{
+		Src:      src,
+		Dst:      dst,
+		Zero:     0,
+		Protocol: uint8(IPUpperProtocolTypeUDP),
+		Len:      util.Hton16(uint16(length)),
+	}
+	var b [UDPPseudoHdrSize]uint8
+	pseudo.Marshal(b[:])
+	return util.Sum16(b[:], 0)
+}
+
+// 書籍では udp_output()
+func (stack *Stack) UDPOutput(src IPEndpoint, dst IPEndpoint, data []uint8) (int, error) {
+	if IPPayloadSizeMax-UDPHdrSize < len(data) {
+		logUDP.Errorf("too long, len=%d", len(data))
+		return 0, fmt.Errorf("%w, len=%d", ErrTooLong, len(data))
+	}
+
+	if src.Addr == IPAddrAny {
+		// 疑似ヘッダの計算に送信元アドレスが必要なため、経路から決定する
+		iface := stack.IPRouteGetIface(dst.Addr)
+		if iface == nil {
+			logUDP.Errorf("iface not found that can reach foreign address, addr=%s", dst.Addr.String())
+			return 0, fmt.Errorf("%w, dst=%s", ErrNoRoute, dst.Addr.String())
+		}
+		src.Addr = iface.unicast
+	}
+
+	total := UDPHdrSize + len(data)
+	hdr := UDPHdr{
+		Src: util.Hton16(src.Port),
+		Dst: util.Hton16(dst.Port),
+		Len: util.Hton16(uint16(total)),
+		Sum: 0,
+	}
+	buf := make([]uint8, total)
+	hdr.Marshal(buf)
+	copy(buf[UDPHdrSize:], data)
+
+	psum := udpPseudoCksum(src.Addr, dst.Addr, total)
+	sum := util.Cksum16(buf, psum)
+	if sum == 0 {
+		// 計算結果が 0 の場合は 0xffff とする（0 はチェックサム無しを意味するため）
+		sum = 0xffff
+	}
+	binary.NativeEndian.PutUint16(buf[6:], sum) // チェックサム値のバイトオーダー変換は行わない
+
+	logUDP.Debugf("%s => %s, len=%d (payload=%d)", src.String(), dst.String(), total, len(data))
+	udpPrint(buf, stack.dumpIPUpperProtocol(IPUpperProtocolTypeUDP))
+
+	if _, err := stack.IPOutput(IPUpperProtocolTypeUDP, buf, src.Addr, dst.Addr); err != nil {
+		logUDP.Errorf("IPOutput() failure")
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// NOTE: 以降の udpPCBXxx() は udp.mutex をロックした状態で呼び出すこと
+
+func (stack *Stack) udpPCBAlloc() *udpPCB {
+	for i := range stack.udp.pcbs {
+		pcb := &stack.udp.pcbs[i]
+		if pcb.state == udpPCBStateFree {
+			pcb.state = udpPCBStateOpen
+			pcb.ctx.init(&stack.udp.mutex)
+			return pcb
+		}
+	}
+	return nil
+}
+
+func (stack *Stack) udpPCBRelease(pcb *udpPCB) {
+	if !pcb.ctx.destroy() {
+		// 休止中のタスクが存在する場合は、起床させて最後に起床したタスクに解放させる
+		pcb.state = udpPCBStateClosing
+		pcb.ctx.wakeup()
+		return
+	}
+
+	pcb.state = udpPCBStateFree
+	pcb.local = IPEndpoint{}
+	pcb.queue = nil
+}
+
+func (stack *Stack) udpPCBSelect(addr IPAddr, port uint16) *udpPCB {
+	for i := range stack.udp.pcbs {
+		pcb := &stack.udp.pcbs[i]
+		if pcb.state != udpPCBStateOpen {
+			continue
+		}
+		if (pcb.local.Addr == IPAddrAny || addr == IPAddrAny || pcb.local.Addr == addr) && pcb.local.Port == port {
+			return pcb
+		}
+	}
+	return nil
+}
+
+func (stack *Stack) udpPCBGet(id int) *udpPCB {
+	if id < 0 || len(stack.udp.pcbs) <= id {
+		return nil
+	}
+	pcb := &stack.udp.pcbs[id]
+	if pcb.state != udpPCBStateOpen {
+		return nil
+	}
+	return pcb
+}
+
+func (stack *Stack) udpPCBID(pcb *udpPCB) int {
+	for i := range stack.udp.pcbs {
+		if &stack.udp.pcbs[i] == pcb {
+			return i
+		}
+	}
+	return -1
+}
+
+// 書籍では udp_open()
+func (stack *Stack) UDPOpen() (int, error) {
+	stack.udp.mutex.Lock()
+	defer stack.udp.mutex.Unlock()
+
+	pcb := stack.udpPCBAlloc()
+	if pcb == nil {
+		logUDP.Errorf("udpPCBAlloc() failure")
+		return -1, fmt.Errorf("%w: udp pcb", ErrNoResource)
+	}
+
+	return stack.udpPCBID(pcb), nil
+}
+
+// 書籍では udp_close()
+func (stack *Stack) UDPClose(id int) error {
+	stack.udp.mutex.Lock()
+	defer stack.udp.mutex.Unlock()
+
+	pcb := stack.udpPCBGet(id)
+	if pcb == nil {
+		logUDP.Errorf("pcb not found, id=%d", id)
+		return fmt.Errorf("%w, id=%d", ErrBadDescriptor, id)
+	}
+
+	stack.udpPCBRelease(pcb)
+	return nil
+}
+
+// 書籍では udp_bind()
+func (stack *Stack) UDPBind(id int, local IPEndpoint) error {
+	stack.udp.mutex.Lock()
+	defer stack.udp.mutex.Unlock()
+
+	pcb := stack.udpPCBGet(id)
+	if pcb == nil {
+		logUDP.Errorf("pcb not found, id=%d", id)
+		return fmt.Errorf("%w, id=%d", ErrBadDescriptor, id)
+	}
+
+	exist := stack.udpPCBSelect(local.Addr, local.Port)
+	if exist != nil {
+		logUDP.Errorf("already in use, id=%d, want=%s, exist=%s", id, local.String(), exist.local.String())
+		return fmt.Errorf("%w, local=%s", ErrAddrInUse, local.String())
+	}
+
+	pcb.local = local
+	logUDP.Debugf("bound, id=%d, local=%s", id, pcb.local.String())
+	return nil
+}
+
+// 書籍では udp_sendto()
+func (stack *Stack) UDPSendTo(id int, data []uint8, foreign IPEndpoint) (int, error) {
+	stack.udp.mutex.Lock()
+
+	pcb := stack.udpPCBGet(id)
+	if pcb == nil {
+		stack.udp.mutex.Unlock()
+		logUDP.Errorf("pcb not found, id=%d", id)
+		return 0, fmt.Errorf("%w, id=%d", ErrBadDescriptor, id)
+	}
+
+	local := pcb.local
+	if local.Addr == IPAddrAny {
+		iface := stack.IPRouteGetIface(foreign.Addr)
+		if iface == nil {
+			stack.udp.mutex.Unlock()
+			logUDP.Errorf("iface not found that can reach foreign address, addr=%s", foreign.Addr.String())
+			return 0, fmt.Errorf("%w, dst=%s", ErrNoRoute, foreign.Addr.String())
+		}
+		local.Addr = iface.unicast
+		logUDP.Debugf("select local address, addr=%s", local.Addr.String())
+	}
+
+	if local.Port == 0 {
+		// 未使用のエフェメラルポートを割り当てる
+		for port := UDPSourcePortMin; port <= UDPSourcePortMax; port++ {
+			if stack.udpPCBSelect(local.Addr, uint16(port)) == nil {
+				local.Port = uint16(port)
+				pcb.local.Port = uint16(port)
+				logUDP.Debugf("dynamic assign local port, port=%d", port)
+				break
+			}
+		}
+		if local.Port == 0 {
+			stack.udp.mutex.Unlock()
+			logUDP.Errorf("failed to dynamic assign local port, addr=%s", local.Addr.String())
+			return 0, fmt.Errorf("%w: ephemeral port, addr=%s", ErrNoResource, local.Addr.String())
+		}
+	}
+
+	// NOTE: ループバックでは送信処理の中で受信処理が呼び出されるため、ロックを解放してから送信する
+	stack.udp.mutex.Unlock()
+
+	return stack.UDPOutput(local, foreign, data)
+}
+
+// 書籍では udp_recvfrom()
+// NOTE: データを受信するか、中断されるまでブロックする
+func (stack *Stack) UDPRecvFrom(id int, buf []uint8) (int, IPEndpoint, error) {
+	stack.udp.mutex.Lock()
+	defer stack.udp.mutex.Unlock()
+
+	pcb := stack.udpPCBGet(id)
+	if pcb == nil {
+		logUDP.Errorf("pcb not found, id=%d", id)
+		return 0, IPEndpoint{}, fmt.Errorf("%w, id=%d", ErrBadDescriptor, id)
+	}
+
+	for len(pcb.queue) == 0 {
+		ok := pcb.ctx.sleep(time.Time{})
+		if pcb.state == udpPCBStateClosing {
+			logUDP.Debugf("closed, id=%d", id)
+			stack.udpPCBRelease(pcb)
+			return 0, IPEndpoint{}, fmt.Errorf("%w, id=%d", ErrClosed, id)
+		}
+		if !ok {
+			logUDP.Debugf("interrupted, id=%d", id)
+			return 0, IPEndpoint{}, fmt.Errorf("%w, id=%d", ErrInterrupted, id)
+		}
+	}
+
+	entry := pcb.queue[0]
+	pcb.queue = pcb.queue[1:]
+
+	// バッファに収まらない部分は切り捨てる
+	n := copy(buf, entry.data)
+	return n, entry.foreign, nil
+}
+
+// ブロックしているユーザーコマンドを中断させる
+// 書籍では udp_event_handler()
+func (stack *Stack) udpEventHandler(arg any) {
+	stack.udp.mutex.Lock()
+	defer stack.udp.mutex.Unlock()
+
+	for i := range stack.udp.pcbs {
+		pcb := &stack.udp.pcbs[i]
+		if pcb.state == udpPCBStateOpen {
+			pcb.ctx.interrupt()
+		}
+	}
+}
+
+func (stack *Stack) UDPInit() error {
+	if err := stack.IPUpperProtocolRegister(&UDPProtocol{
+		IPUpperProtocolInfo{
+			Protocol: IPUpperProtocolTypeUDP,
+		},
+	}); err != nil {
+		logUDP.Errorf("IPUpperProtocolRegister() failure")
+		return err
+	}
+
+	if err := stack.NetEventSubscribe(stack.udpEventHandler, nil); err != nil {
+		logUDP.Errorf("NetEventSubscribe() failure")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package microps
+
+import (
+	"testing"
+
+	"github.com/bugph0bia/go-microps/internal/util"
+)
+
+func TestUDPHdrMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  UDPHdr
+		wire []uint8
+	}{
+		{
+			name: "DNS response",
+			hdr: UDPHdr{
+				Src: util.Hton16(53),
+				Dst: util.Hton16(49152),
+				Len: util.Hton16(28),
+				Sum: util.Hton16(0xabcd),
+			},
+			wire: []uint8{0x00, 0x35, 0xc0, 0x00, 0x00, 0x1c, 0xab, 0xcd},
+		},
+		{
+			name: "no checksum",
+			hdr: UDPHdr{
+				Src: util.Hton16(7),
+				Dst: util.Hton16(7),
+				Len: util.Hton16(UDPHdrSize),
+			},
+			wire: []uint8{0x00, 0x07, 0x00, 0x07, 0x00, 0x08, 0x00, 0x00},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHdrRoundTrip(t, &tt.hdr, &UDPHdr{}, tt.wire)
+		})
+	}
+}
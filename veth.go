@@ -0,0 +1,262 @@
+package microps
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ----------------------------------------------------------------------------
+// 仮想リンク（書籍には無い機能）
+//
+// NOTE:
+//   Ethernet のケーブルで接続したように、一方のデバイスから送信したフレームを他方のデバイスで受信する
+//   受信したフレームはキューに格納してIRQを発生させ、受信処理は割り込みハンドラで行う
+//   TAP デバイスと異なり root 権限が不要なため、複数のホスト（Stack）を同じプロセスで接続して試験できる
+// ----------------------------------------------------------------------------
+
+// ----------------------------------------------------------------------------
+// 定数
+// ----------------------------------------------------------------------------
+
+// 受信キューの長さの上限（超えた場合は破棄する）
+const VethQueueSizeMax = 256
+
+// ----------------------------------------------------------------------------
+// インタフェース
+// ----------------------------------------------------------------------------
+
+// 仮想リンクの端点
+// NOTE: frame は複数の端点に渡されることがあるため変更しないこと
+type etherLinkEndpoint interface {
+	receive(frame []uint8)
+}
+
+// ----------------------------------------------------------------------------
+// データ
+// ----------------------------------------------------------------------------
+
+// 仮想リンクのデバイス
+type VethDevice struct {
+	NetDeviceInfo
+	irq   IntrIRQ
+	up    atomic.Bool // フレームを受信するか（Open() されているか）
+	mutex sync.Mutex
+	peer  etherLinkEndpoint // 接続先
+	queue [][]uint8         // 受信済みフレームのキュー
+	drops uint64            // キューが溢れて破棄したフレームの数
+}
+
+func (dev *VethDevice) Info() *NetDeviceInfo {
+	return &dev.NetDeviceInfo
+}
+
+func (dev *VethDevice) Open() bool {
+	dev.up.Store(true)
+	return true
+}
+
+func (dev *VethDevice) Close() bool {
+	dev.up.Store(false)
+
+	// 未処理のフレームは破棄する
+	dev.mutex.Lock()
+	dev.queue = nil
+	dev.mutex.Unlock()
+	return true
+}
+
+func (dev *VethDevice) Output(typ NetProtocolType, data []uint8, dst any) bool {
+	return EtherOutputHelper(dev, typ, data, dst, vethTransmit)
+}
+
+// 受信キューが溢れて破棄したフレームの数
+func (dev *VethDevice) Drops() uint64 {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	return dev.drops
+}
+
+// 接続先から送信されたフレームを受信キューに格納する
+func (dev *VethDevice) receive(frame []uint8) {
+	if !dev.up.Load() {
+		// ケーブルの先のデバイスが停止している場合と同様に破棄する
+		return
+	}
+
+	dev.mutex.Lock()
+	if VethQueueSizeMax <= len(dev.queue) {
+		dev.drops++
+		dev.mutex.Unlock()
+		logEther.Errorf("queue is full, dev=%s", dev.Name)
+		return
+	}
+	dev.queue = append(dev.queue, frame)
+	dev.mutex.Unlock()
+
+	dev.stack.intrRaise(dev.irq)
+}
+
+// 未処理のフレームが存在するか
+func (dev *VethDevice) pending() bool {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	return len(dev.queue) > 0
+}
+
+// 受信済みのフレームを１つ取り出す
+func (dev *VethDevice) dequeue() ([]uint8, bool) {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	if len(dev.queue) == 0 {
+		return nil, false
+	}
+	frame := dev.queue[0]
+	dev.queue = dev.queue[1:]
+	return frame, true
+}
+
+// 接続先を設定する
+// NOTE: 既に接続されている場合は失敗する
+func (dev *VethDevice) connect(peer etherLinkEndpoint) bool {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	if dev.peer != nil {
+		return false
+	}
+	dev.peer = peer
+	return true
+}
+
+func (dev *VethDevice) disconnect() {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+
+	dev.peer = nil
+}
+
+// ----------------------------------------------------------------------------
+// メインロジック
+// ----------------------------------------------------------------------------
+
+func vethTransmit(dev NetDevice, frame []uint8) bool {
+	veth := dev.(*VethDevice)
+
+	veth.mutex.Lock()
+	peer := veth.peer
+	veth.mutex.Unlock()
+
+	if peer == nil {
+		// ケーブルが接続されていない場合と同様に、送信には成功して破棄されたものとする
+		logEther.Debugf("not connected, dev=%s", veth.Name)
+		return true
+	}
+	peer.receive(frame)
+	return true
+}
+
+func vethRead(dev NetDevice, buf []uint8) (int, bool) {
+	veth := dev.(*VethDevice)
+	frame, ok := veth.dequeue()
+	if !ok {
+		return 0, false
+	}
+	return copy(buf, frame), true
+}
+
+// 割り込みハンドラ
+func vethISR(irq IntrIRQ, dev NetDevice) {
+	veth, ok := dev.(*VethDevice)
+	if !ok {
+		logEther.Errorf("not veth device, dev=%s", dev.Info().Name)
+		return
+	}
+
+	// IRQ はまとめて通知されることがあるため、キューが空になるまで処理する
+	for veth.pending() {
+		EtherInputHelper(veth, vethRead)
+	}
+}
+
+// NOTE: addr に空文字列を指定した場合はランダムなローカル管理アドレスを使用する
+func (stack *Stack) VethInit(addr string) (NetDevice, error) {
+	dev := VethDevice{
+		irq: stack.intrIRQAlloc(),
+	}
+	EtherSetup(&dev)
+
+	hwaddr := etherAddrRandom()
+	if addr != "" {
+		var ok bool
+		hwaddr, ok = ParseEtherAddr(addr)
+		if !ok {
+			logEther.Errorf("ParseEtherAddr() failure, addr=%s", addr)
+			return nil, fmt.Errorf("%w, addr=%s", ErrInvalidAddr, addr)
+		}
+	}
+	copy(dev.Addr[:], hwaddr[:])
+
+	if err := stack.NetDeviceRegister(&dev); err != nil {
+		logEther.Errorf("NetDeviceRegister() failure")
+		return nil, err
+	}
+
+	if err := stack.intrRegister(dev.irq, vethISR, IntrIRQFlagShared, &dev); err != nil {
+		logEther.Errorf("intrRegister() failure, dev=%s", dev.Name)
+		return nil, err
+	}
+
+	logEther.Infof("veth device initialized, dev=%s, addr=%s", dev.Name, hwaddr.String())
+	return &dev, nil
+}
+
+// ２つの仮想リンクのデバイスを接続する
+// NOTE: 別の Stack に登録したデバイスどうしを接続することもできる
+func VethConnect(dev1 NetDevice, dev2 NetDevice) error {
+	veth1, ok1 := dev1.(*VethDevice)
+	veth2, ok2 := dev2.(*VethDevice)
+	if !ok1 || !ok2 {
+		logEther.Errorf("not veth device, dev=%s, %s", dev1.Info().Name, dev2.Info().Name)
+		return fmt.Errorf("%w: not veth device, dev=%s, %s", ErrInvalidArgument, dev1.Info().Name, dev2.Info().Name)
+	}
+	if veth1 == veth2 {
+		logEther.Errorf("cannot connect to itself, dev=%s", veth1.Name)
+		return fmt.Errorf("%w: cannot connect to itself, dev=%s", ErrInvalidArgument, veth1.Name)
+	}
+
+	if !veth1.connect(veth2) {
+		logEther.Errorf("already connected, dev=%s", veth1.Name)
+		return fmt.Errorf("%w: already connected, dev=%s", ErrInvalidState, veth1.Name)
+	}
+	if !veth2.connect(veth1) {
+		veth1.disconnect()
+		logEther.Errorf("already connected, dev=%s", veth2.Name)
+		return fmt.Errorf("%w: already connected, dev=%s", ErrInvalidState, veth2.Name)
+	}
+
+	logEther.Infof("connected, dev=%s <=> %s", veth1.Name, veth2.Name)
+	return nil
+}
+
+// 仮想リンクのデバイスを２つ生成して接続する（アドレスはランダムに決める）
+func VethPairInit(stack1 *Stack, stack2 *Stack) (NetDevice, NetDevice, error) {
+	dev1, err := stack1.VethInit("")
+	if err != nil {
+		logEther.Errorf("VethInit() failure")
+		return nil, nil, err
+	}
+	dev2, err := stack2.VethInit("")
+	if err != nil {
+		logEther.Errorf("VethInit() failure")
+		return nil, nil, err
+	}
+	if err := VethConnect(dev1, dev2); err != nil {
+		logEther.Errorf("VethConnect() failure")
+		return nil, nil, err
+	}
+	return dev1, dev2, nil
+}
@@ -0,0 +1,229 @@
+package microps
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// 応答を待つ時間の上限
+const testTimeout = 10 * time.Second
+
+// 試験用のホスト
+type testHost struct {
+	stack *Stack
+	dev   NetDevice
+	iface *IPIface
+}
+
+func (host *testHost) hwaddr() EtherAddr {
+	var ha EtherAddr
+	copy(ha[:], host.dev.Info().Addr[:])
+	return ha
+}
+
+// エラー以外のログを出力しない
+// NOTE: 後始末（NetShutdown()）のログも抑えるため、最後に戻す
+// NOTE: ログレベルはプロセス全体で共通のため、これを呼び出すテストは t.Parallel() で並行に実行しないこと
+func testLogQuiet(t *testing.T) {
+	SetLogLevel(slog.LevelError)
+	t.Cleanup(func() {
+		SetLogLevel(slog.LevelDebug)
+	})
+}
+
+// 仮想リンクのデバイスとIPインタフェースを登録した Stack を生成する（起動は run() で行う）
+func newTestHost(t *testing.T, addr string) *testHost {
+	t.Helper()
+
+	stack := New(Options{})
+	if err := stack.NetInit(); err != nil {
+		t.Fatalf("NetInit() failure: %v", err)
+	}
+	dev, err := stack.VethInit("")
+	if err != nil {
+		t.Fatalf("VethInit() failure: %v", err)
+	}
+	iface, err := IPIfaceAlloc(addr, "255.255.255.0")
+	if err != nil {
+		t.Fatalf("IPIfaceAlloc() failure: %v", err)
+	}
+	if err := stack.IPIfaceRegister(dev, iface); err != nil {
+		t.Fatalf("IPIfaceRegister() failure: %v", err)
+	}
+	return &testHost{stack: stack, dev: dev, iface: iface}
+}
+
+func (host *testHost) run(t *testing.T) {
+	t.Helper()
+
+	if err := host.stack.NetRun(); err != nil {
+		t.Fatalf("NetRun() failure: %v", err)
+	}
+	t.Cleanup(func() {
+		host.stack.NetShutdown()
+	})
+}
+
+// アドレス解決が完了するまで待つ
+func testARPResolve(t *testing.T, host *testHost, peer *testHost) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		ha, err := host.stack.ARPResolve(host.iface, peer.iface.unicast)
+		if err == nil {
+			if ha != peer.hwaddr() {
+				t.Fatalf("ARPResolve() = %s, want %s", ha.String(), peer.hwaddr().String())
+			}
+			return
+		}
+		if !errors.Is(err, ErrARPIncomplete) {
+			t.Fatalf("ARPResolve() failure: %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ARPResolve() timeout, pa=%s", peer.iface.unicast.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// server で受信したデータを送信元に返し、client で受信できることを確かめる
+func testUDPEcho(t *testing.T, client *testHost, server *testHost) {
+	t.Helper()
+
+	soc, err := server.stack.UDPOpen()
+	if err != nil {
+		t.Fatalf("UDPOpen() failure: %v", err)
+	}
+	defer server.stack.UDPClose(soc)
+	if err := server.stack.UDPBind(soc, IPEndpoint{Addr: IPAddrAny, Port: 7}); err != nil {
+		t.Fatalf("UDPBind() failure: %v", err)
+	}
+	go func() {
+		buf := make([]uint8, 2048)
+		for {
+			n, foreign, err := server.stack.UDPRecvFrom(soc, buf)
+			if err != nil {
+				return
+			}
+			server.stack.UDPSendTo(soc, buf[:n], foreign)
+		}
+	}()
+
+	csoc, err := client.stack.UDPOpen()
+	if err != nil {
+		t.Fatalf("UDPOpen() failure: %v", err)
+	}
+	defer client.stack.UDPClose(csoc)
+
+	want := []uint8("hello, veth")
+	received := make(chan []uint8, 1)
+	go func() {
+		buf := make([]uint8, 2048)
+		n, _, err := client.stack.UDPRecvFrom(csoc, buf)
+		if err != nil {
+			received <- nil
+			return
+		}
+		received <- buf[:n]
+	}()
+
+	if _, err := client.stack.UDPSendTo(csoc, want, IPEndpoint{Addr: server.iface.unicast, Port: 7}); err != nil {
+		t.Fatalf("UDPSendTo() failure: %v", err)
+	}
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, want) {
+			t.Fatalf("UDPRecvFrom() = %q, want %q", got, want)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("UDPRecvFrom() timeout")
+	}
+}
+
+// client から server に TCP でデータを送信し、すべて届くことを確かめる
+func testTCPTransfer(t *testing.T, client *testHost, server *testHost, size int) {
+	t.Helper()
+
+	want := make([]uint8, size)
+	for i := range want {
+		want[i] = uint8(i * 7)
+	}
+
+	lsoc, err := server.stack.TCPOpen()
+	if err != nil {
+		t.Fatalf("TCPOpen() failure: %v", err)
+	}
+	defer server.stack.TCPClose(lsoc)
+	if err := server.stack.TCPBind(lsoc, IPEndpoint{Addr: IPAddrAny, Port: 7}); err != nil {
+		t.Fatalf("TCPBind() failure: %v", err)
+	}
+	if err := server.stack.TCPListen(lsoc, 1); err != nil {
+		t.Fatalf("TCPListen() failure: %v", err)
+	}
+
+	received := make(chan []uint8, 1)
+	go func() {
+		soc, _, err := server.stack.TCPAccept(lsoc)
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer server.stack.TCPClose(soc)
+
+		var got []uint8
+		buf := make([]uint8, 4096)
+		for len(got) < len(want) {
+			n, err := server.stack.TCPReceive(soc, buf)
+			if err != nil || n == 0 {
+				break
+			}
+			got = append(got, buf[:n]...)
+		}
+		received <- got
+	}()
+
+	soc, err := client.stack.TCPOpen()
+	if err != nil {
+		t.Fatalf("TCPOpen() failure: %v", err)
+	}
+	defer client.stack.TCPClose(soc)
+	if err := client.stack.TCPConnect(soc, IPEndpoint{Addr: server.iface.unicast, Port: 7}); err != nil {
+		t.Fatalf("TCPConnect() failure: %v", err)
+	}
+	for off := 0; off < len(want); {
+		n, err := client.stack.TCPSend(soc, want[off:])
+		if err != nil {
+			t.Fatalf("TCPSend() failure: %v", err)
+		}
+		off += n
+	}
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, want) {
+			t.Fatalf("TCPReceive() received %d bytes, want %d bytes", len(got), len(want))
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("TCPReceive() timeout")
+	}
+}
+
+func TestVethPair(t *testing.T) {
+	testLogQuiet(t)
+
+	host1 := newTestHost(t, "192.0.2.1")
+	host2 := newTestHost(t, "192.0.2.2")
+	if err := VethConnect(host1.dev, host2.dev); err != nil {
+		t.Fatalf("VethConnect() failure: %v", err)
+	}
+	host1.run(t)
+	host2.run(t)
+
+	testARPResolve(t, host1, host2)
+	testUDPEcho(t, host1, host2)
+	testTCPTransfer(t, host1, host2, 64*1024)
+}